@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Start an agent that caches decrypted environment keys",
+	Long: `Start an agent that caches decrypted environment keys in memory, similar to ssh-agent.
+
+Other commands find the agent through the EPICENV_AUTH_SOCK env var, and will use a cached key instead
+of decrypting it with your SSH key (and asking for its passphrase) every time.
+
+The agent forks into the background and prints the shell commands to set EPICENV_AUTH_SOCK, so use it like:
+  eval "$(epicenv agent)"
+
+Keys are forgotten after --ttl. Environments passed to --confirm require confirmation through
+EPICENV_ASKPASS or SSH_ASKPASS every time their cached key is used.
+
+Examples:
+  eval "$(epicenv agent --ttl 8h)"
+  eval "$(epicenv agent --confirm prod --confirm staging)"
+  epicenv agent --foreground --socket /tmp/epicenv.sock`,
+	Run:  runAgent,
+	Args: cobra.NoArgs,
+}
+
+var agentLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Lock the agent with a passphrase, cached keys can't be used until it is unlocked",
+	Run:   runAgentLock,
+	Args:  cobra.NoArgs,
+}
+
+var agentUnlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Unlock the agent",
+	Run:   runAgentUnlock,
+	Args:  cobra.NoArgs,
+}
+
+var agentClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove all cached keys from the agent",
+	Run:   runAgentClear,
+	Args:  cobra.NoArgs,
+}
+
+var (
+	agentSocketFlag     string
+	agentTTLFlag        time.Duration
+	agentConfirmFlag    []string
+	agentForegroundFlag bool
+)
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentLockCmd)
+	agentCmd.AddCommand(agentUnlockCmd)
+	agentCmd.AddCommand(agentClearCmd)
+
+	agentCmd.Flags().StringVar(&agentSocketFlag, "socket", "", "Path of the socket to listen on (default in $XDG_RUNTIME_DIR, or a new directory in the temp dir)")
+	agentCmd.Flags().DurationVar(&agentTTLFlag, "ttl", time.Hour, "How long to cache keys for")
+	agentCmd.Flags().StringArrayVar(&agentConfirmFlag, "confirm", nil, "Environment that requires confirmation every time its key is used, can be repeated")
+	agentCmd.Flags().BoolVar(&agentForegroundFlag, "foreground", false, "Stay in the foreground instead of forking")
+}
+
+const (
+	agentOpGet    = "get"
+	agentOpPut    = "put"
+	agentOpLock   = "lock"
+	agentOpUnlock = "unlock"
+	agentOpClear  = "clear"
+)
+
+var ErrAgentLocked = errors.New("agent is locked")
+
+type (
+	agentRequest struct {
+		Op string
+		// Key identifies the cached value, see agentCacheKey
+		Key string `json:",omitempty"`
+		// Env is the environment the value belongs to, for confirmation
+		Env        string `json:",omitempty"`
+		Value      []byte `json:",omitempty"`
+		Passphrase string `json:",omitempty"`
+	}
+
+	agentResponse struct {
+		Value []byte `json:",omitempty"`
+		Found bool   `json:",omitempty"`
+		Error string `json:",omitempty"`
+	}
+
+	agentEntry struct {
+		value   []byte
+		env     string
+		expires time.Time
+	}
+
+	// keyAgent holds decrypted keys in memory
+	keyAgent struct {
+		mu      sync.Mutex
+		entries map[string]agentEntry
+		ttl     time.Duration
+		confirm []string
+		// lockHash is the hash of the lock passphrase, nil when unlocked
+		lockHash []byte
+		// confirmFunc asks whether the cached key for an env may be used
+		confirmFunc func(env string) bool
+	}
+)
+
+func newKeyAgent(ttl time.Duration, confirm []string) *keyAgent {
+	return &keyAgent{
+		entries:     make(map[string]agentEntry),
+		ttl:         ttl,
+		confirm:     confirm,
+		confirmFunc: confirmWithAskpass,
+	}
+}
+
+func (a *keyAgent) handle(req agentRequest) agentResponse {
+	if req.Op == agentOpGet {
+		return a.get(req)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.Op {
+	case agentOpPut:
+		if a.lockHash != nil {
+			return agentResponse{Error: ErrAgentLocked.Error()}
+		}
+		a.entries[req.Key] = agentEntry{
+			value:   req.Value,
+			env:     req.Env,
+			expires: time.Now().Add(a.ttl),
+		}
+		return agentResponse{}
+
+	case agentOpLock:
+		if a.lockHash != nil {
+			return agentResponse{Error: ErrAgentLocked.Error()}
+		}
+		hash := sha256.Sum256([]byte(req.Passphrase))
+		a.lockHash = hash[:]
+		return agentResponse{}
+
+	case agentOpUnlock:
+		hash := sha256.Sum256([]byte(req.Passphrase))
+		if a.lockHash == nil || subtle.ConstantTimeCompare(a.lockHash, hash[:]) != 1 {
+			return agentResponse{Error: "incorrect passphrase"}
+		}
+		a.lockHash = nil
+		return agentResponse{}
+
+	case agentOpClear:
+		a.entries = make(map[string]agentEntry)
+		return agentResponse{}
+
+	default:
+		return agentResponse{Error: fmt.Sprintf("unknown operation %s", req.Op)}
+	}
+}
+
+// get returns a cached key. Confirmation is asked without holding the lock, so other clients aren't
+// blocked while it waits, and the key is looked up again afterwards in case the agent was locked or cleared.
+func (a *keyAgent) get(req agentRequest) agentResponse {
+	lookup := func() (agentEntry, *agentResponse) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if a.lockHash != nil {
+			return agentEntry{}, &agentResponse{Error: ErrAgentLocked.Error()}
+		}
+		entry, exists := a.entries[req.Key]
+		if !exists {
+			return agentEntry{}, &agentResponse{}
+		}
+		if time.Now().After(entry.expires) {
+			delete(a.entries, req.Key)
+			return agentEntry{}, &agentResponse{}
+		}
+		return entry, nil
+	}
+
+	entry, res := lookup()
+	if res != nil {
+		return *res
+	}
+	if !lo.Contains(a.confirm, entry.env) {
+		return agentResponse{Value: entry.value, Found: true}
+	}
+
+	if !a.confirmFunc(entry.env) {
+		return agentResponse{Error: fmt.Sprintf("use of the key for %s was not confirmed", entry.env)}
+	}
+	entry, res = lookup()
+	if res != nil {
+		return *res
+	}
+	return agentResponse{Value: entry.value, Found: true}
+}
+
+// expire drops any entries past their TTL, so keys don't sit in memory until the next request
+func (a *keyAgent) expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, entry := range a.entries {
+		if time.Now().After(entry.expires) {
+			delete(a.entries, key)
+		}
+	}
+}
+
+func (a *keyAgent) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error in listener.Accept: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var req agentRequest
+			err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req)
+			if err != nil {
+				logger.Debug().Err(err).Msg("error decoding agent request")
+				return
+			}
+
+			err = json.NewEncoder(conn).Encode(a.handle(req))
+			if err != nil {
+				logger.Debug().Err(err).Msg("error encoding agent response")
+			}
+		}()
+	}
+}
+
+// confirmWithAskpass asks for confirmation with an ssh-askpass style program, denying if there isn't one
+func confirmWithAskpass(env string) bool {
+	askpass := lo.CoalesceOrEmpty(os.Getenv("EPICENV_ASKPASS"), os.Getenv("SSH_ASKPASS"))
+	if askpass == "" {
+		logger.Warn().Msgf("Denying use of the key for %s, set EPICENV_ASKPASS or SSH_ASKPASS to confirm", env)
+		return false
+	}
+
+	confirmCmd := exec.Command(askpass, fmt.Sprintf("Allow use of the epicenv key for %s?", env))
+	confirmCmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+	return confirmCmd.Run() == nil
+}
+
+// defaultAgentSocketPath is in $XDG_RUNTIME_DIR, which only we can write to, otherwise in a new directory in the
+// temp dir. A fixed path in the temp dir could be created by someone else first, who would then get our keys.
+func defaultAgentSocketPath() (string, error) {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "epicenv", "agent.sock"), nil
+	}
+
+	dir, err := os.MkdirTemp("", "epicenv-agent-")
+	if err != nil {
+		return "", fmt.Errorf("error in os.MkdirTemp: %w", err)
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+func runAgent(cmd *cobra.Command, args []string) {
+	socketPath := agentSocketFlag
+	if socketPath == "" {
+		var err error
+		socketPath, err = defaultAgentSocketPath()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error creating socket directory")
+		}
+	}
+
+	if !agentForegroundFlag {
+		// Fork ourselves into the background, and print how to find us
+		daemonArgs := []string{"agent", "--foreground", "--socket", socketPath, "--ttl", agentTTLFlag.String()}
+		for _, env := range agentConfirmFlag {
+			daemonArgs = append(daemonArgs, "--confirm", env)
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error finding the epicenv executable")
+		}
+
+		daemon := exec.Command(executable, daemonArgs...)
+		err = daemon.Start()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error starting agent")
+		}
+
+		fmt.Printf("EPICENV_AUTH_SOCK=%s; export EPICENV_AUTH_SOCK;\n", socketPath)
+		fmt.Printf("echo Agent pid %d;\n", daemon.Process.Pid)
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(socketPath), 0700)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error creating socket directory")
+	}
+
+	// Clean up a socket left behind by an agent that didn't exit cleanly
+	if _, err := net.Dial("unix", socketPath); err == nil {
+		logger.Fatal().Msgf("An agent is already listening on %s", socketPath)
+	}
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error listening on %s", socketPath)
+	}
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error setting socket permissions")
+	}
+
+	agent := newKeyAgent(agentTTLFlag, agentConfirmFlag)
+
+	// Survive the terminal that started us closing, and clean up the socket on the way out
+	signal.Ignore(syscall.SIGHUP)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		listener.Close()
+	}()
+
+	go func() {
+		for range time.Tick(time.Second) {
+			agent.expire()
+		}
+	}()
+
+	logger.Debug().Msgf("Agent listening on %s", socketPath)
+	err = agent.serve(listener)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error serving agent")
+	}
+}
+
+func runAgentLock(cmd *cobra.Command, args []string) {
+	passphrase := readStdinHidden("Enter lock passphrase: ")
+	if passphrase != readStdinHidden("Again: ") {
+		logger.Fatal().Msg("Passphrases do not match")
+	}
+
+	_, err := agentCall(agentRequest{Op: agentOpLock, Passphrase: passphrase})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error locking agent")
+	}
+
+	logger.Info().Msg("Agent locked")
+}
+
+func runAgentUnlock(cmd *cobra.Command, args []string) {
+	passphrase := readStdinHidden("Enter lock passphrase: ")
+
+	_, err := agentCall(agentRequest{Op: agentOpUnlock, Passphrase: passphrase})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error unlocking agent")
+	}
+
+	logger.Info().Msg("Agent unlocked")
+}
+
+func runAgentClear(cmd *cobra.Command, args []string) {
+	_, err := agentCall(agentRequest{Op: agentOpClear})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error clearing agent")
+	}
+
+	logger.Info().Msg("Removed all cached keys")
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+var ErrNoAgent = errors.New("EPICENV_AUTH_SOCK is not set, is the agent running?")
+
+// agentCall sends a single request to the agent at EPICENV_AUTH_SOCK
+func agentCall(req agentRequest) (*agentResponse, error) {
+	socketPath := os.Getenv("EPICENV_AUTH_SOCK")
+	if socketPath == "" {
+		return nil, ErrNoAgent
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to agent: %w", err)
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending agent request: %w", err)
+	}
+
+	var res agentResponse
+	err = json.NewDecoder(conn).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("error reading agent response: %w", err)
+	}
+
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+
+	return &res, nil
+}
+
+// agentCacheKey identifies the decrypted key of keysFile, so a rotated key is never confused with an older one.
+// The generation alone isn't enough, a keys.json from another branch or a new init can have the same one with a
+// different key, so the wrapped keys are part of it.
+func agentCacheKey(rootEnv string, keysFile *KeysFile) string {
+	wrapped := lo.Map(keysFile.EncryptedKeys, func(item EncryptedKey, index int) string {
+		return item.EncryptedSharedKey
+	})
+	slices.Sort(wrapped)
+	hash := sha256.Sum256([]byte(strings.Join(wrapped, "\n")))
+	return fmt.Sprintf("%s/%s@%d/%s", getEpicEnvPath(), rootEnv, keysFile.Generation, hex.EncodeToString(hash[:8]))
+}
+
+// agentGet returns a cached key from the agent if there is one
+func agentGet(key, env string) ([]byte, bool) {
+	res, err := agentCall(agentRequest{Op: agentOpGet, Key: key, Env: env})
+	if errors.Is(err, ErrNoAgent) {
+		return nil, false
+	}
+	if err != nil {
+		logger.Debug().Err(err).Msg("error getting key from agent")
+		return nil, false
+	}
+
+	return res.Value, res.Found
+}
+
+// agentPut caches a key in the agent if there is one
+func agentPut(key, env string, value []byte) {
+	_, err := agentCall(agentRequest{Op: agentOpPut, Key: key, Env: env, Value: value})
+	if err != nil && !errors.Is(err, ErrNoAgent) {
+		logger.Debug().Err(err).Msg("error caching key in agent")
+	}
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyAgent(t *testing.T) {
+	agent := newKeyAgent(time.Hour, []string{"prod"})
+	confirmed := false
+	agent.confirmFunc = func(env string) bool {
+		return confirmed
+	}
+
+	agent.handle(agentRequest{Op: agentOpPut, Key: "local@0", Env: "local", Value: []byte("key")})
+	res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"})
+	if !res.Found || !bytes.Equal(res.Value, []byte("key")) {
+		t.Fatalf("expected cached key, got %+v", res)
+	}
+
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@1"}); res.Found {
+		t.Fatal("found a key for another generation")
+	}
+
+	// Confirmation
+	agent.handle(agentRequest{Op: agentOpPut, Key: "prod@0", Env: "prod", Value: []byte("prodkey")})
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "prod@0"}); res.Found || res.Error == "" {
+		t.Fatal("got an unconfirmed key")
+	}
+	confirmed = true
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "prod@0"}); !res.Found {
+		t.Fatalf("did not get a confirmed key: %+v", res)
+	}
+
+	// Locking
+	agent.handle(agentRequest{Op: agentOpLock, Passphrase: "hunter2"})
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"}); res.Found || res.Error != ErrAgentLocked.Error() {
+		t.Fatalf("got a key from a locked agent: %+v", res)
+	}
+	if res := agent.handle(agentRequest{Op: agentOpUnlock, Passphrase: "wrong"}); res.Error == "" {
+		t.Fatal("unlocked with the wrong passphrase")
+	}
+	agent.handle(agentRequest{Op: agentOpUnlock, Passphrase: "hunter2"})
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"}); !res.Found {
+		t.Fatalf("did not get a key after unlocking: %+v", res)
+	}
+
+	// Clearing
+	agent.handle(agentRequest{Op: agentOpClear})
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"}); res.Found {
+		t.Fatal("got a key after clearing")
+	}
+
+	// Expiry
+	agent.ttl = -time.Second
+	agent.handle(agentRequest{Op: agentOpPut, Key: "local@0", Env: "local", Value: []byte("key")})
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"}); res.Found {
+		t.Fatal("got an expired key")
+	}
+}
+
+func TestAgentSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go newKeyAgent(time.Hour, nil).serve(listener)
+
+	t.Setenv("EPICENV_AUTH_SOCK", socketPath)
+
+	if _, found := agentGet("local@0", "local"); found {
+		t.Fatal("found a key in an empty agent")
+	}
+
+	agentPut("local@0", "local", []byte("key"))
+	value, found := agentGet("local@0", "local")
+	if !found || !bytes.Equal(value, []byte("key")) {
+		t.Fatalf("expected cached key, got %q", value)
+	}
+}
+
+func TestKeyAgentConfirmDoesNotBlock(t *testing.T) {
+	agent := newKeyAgent(time.Hour, []string{"prod"})
+	asked := make(chan struct{})
+	answer := make(chan bool)
+	agent.confirmFunc = func(env string) bool {
+		close(asked)
+		return <-answer
+	}
+
+	agent.handle(agentRequest{Op: agentOpPut, Key: "prod@0", Env: "prod", Value: []byte("prodkey")})
+	agent.handle(agentRequest{Op: agentOpPut, Key: "local@0", Env: "local", Value: []byte("key")})
+
+	done := make(chan agentResponse)
+	go func() {
+		done <- agent.handle(agentRequest{Op: agentOpGet, Key: "prod@0"})
+	}()
+	<-asked
+
+	// Other clients are served while the confirmation is pending
+	if res := agent.handle(agentRequest{Op: agentOpGet, Key: "local@0"}); !res.Found {
+		t.Fatalf("did not get a key while a confirmation was pending: %+v", res)
+	}
+
+	// Clearing while waiting means there is nothing to return anymore
+	agent.handle(agentRequest{Op: agentOpClear})
+	answer <- true
+	if res := <-done; res.Found {
+		t.Fatalf("got a key that was cleared while confirming: %+v", res)
+	}
+}
+
+func TestDefaultAgentSocketPath(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	socketPath, err := defaultAgentSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(runtimeDir, "epicenv", "agent.sock"); socketPath != want {
+		t.Errorf("defaultAgentSocketPath() = %s, want %s", socketPath, want)
+	}
+
+	// Without a runtime dir every agent gets a new directory that only we can use
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+	first, err := defaultAgentSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := defaultAgentSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("defaultAgentSocketPath() returned %s twice", first)
+	}
+	info, err := os.Stat(filepath.Dir(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode = %v, want 0700", info.Mode().Perm())
+	}
+}
+
+func TestAgentCacheKey(t *testing.T) {
+	keysFile := &KeysFile{Generation: 1, EncryptedKeys: []EncryptedKey{{Username: "alice", EncryptedSharedKey: "wrapped"}}}
+	// Another branch at the same generation, with another key
+	other := &KeysFile{Generation: 1, EncryptedKeys: []EncryptedKey{{Username: "alice", EncryptedSharedKey: "other"}}}
+
+	if agentCacheKey("local", keysFile) == agentCacheKey("local", other) {
+		t.Error("keys files with different keys at the same generation have the same cache key")
+	}
+	if agentCacheKey("local", keysFile) != agentCacheKey("local", &KeysFile{Generation: 1, EncryptedKeys: keysFile.EncryptedKeys}) {
+		t.Error("the same keys file has different cache keys")
+	}
+}
@@ -20,14 +20,15 @@ var (
 	epicEnvDir string
 )
 
+// readStdinHidden prompts on stderr so it doesn't end up in any output that is being captured
 func readStdinHidden(prompt string) string {
-	fmt.Print(prompt)
+	fmt.Fprint(os.Stderr, prompt)
 	// IDE might complain, but the cast is necessary for some OSs, because Stdin is a var instead of an untyped const
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println() // Move to the next line after input
+	fmt.Fprintln(os.Stderr) // Move to the next line after input
 	return string(bytePassword)
 }
 
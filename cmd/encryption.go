@@ -6,13 +6,30 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"golang.org/x/crypto/ssh"
 	"io"
+	"math/big"
 	"os"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// x25519WrapInfo is the HKDF info string used when wrapping keys for Ed25519 recipients
+const x25519WrapInfo = "epicenv x25519 key wrap v1"
+
+// Algorithms used to encrypt the symmetric key for an EncryptedKey
+const (
+	// algorithmRSAPKCS1v15 is the legacy RSA wrapping, an empty algorithm on an RSA key also means this
+	algorithmRSAPKCS1v15 = "rsa-pkcs1v15"
+	algorithmRSAOAEP     = "rsa-oaep-sha256"
+	algorithmX25519      = "x25519-hkdf-sha256-aes256gcm"
 )
 
 func generateAESKey() []byte {
@@ -24,8 +41,9 @@ func generateAESKey() []byte {
 	return key
 }
 
-// Encrypt a string using AES-GCM and return the base64-encoded result
-func encryptAESGCM(key []byte, plaintext string) (string, error) {
+// Encrypt a string using AES-GCM and return the base64-encoded result.
+// additionalData is authenticated but not encrypted, and must be provided again to decrypt.
+func encryptAESGCM(key []byte, plaintext string, additionalData []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -41,12 +59,12 @@ func encryptAESGCM(key []byte, plaintext string) (string, error) {
 		return "", err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), additionalData)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// Decrypt a base64-encoded string using AES-GCM
-func decryptAESGCM(key []byte, ciphertextBase64 string) (string, error) {
+// Decrypt a base64-encoded string using AES-GCM, additionalData must match what it was encrypted with
+func decryptAESGCM(key []byte, ciphertextBase64 string, additionalData []byte) (string, error) {
 	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextBase64)
 	if err != nil {
 		return "", err
@@ -68,7 +86,7 @@ func decryptAESGCM(key []byte, ciphertextBase64 string) (string, error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return "", err
 	}
@@ -76,75 +94,240 @@ func decryptAESGCM(key []byte, ciphertextBase64 string) (string, error) {
 	return string(plaintext), nil
 }
 
-// Returns a base64 encoded string
-func encryptWithPublicKey(data []byte, publicKey string) (string, error) {
+// currentSecretVersion is the EncryptedSecret version where values are bound to their environment,
+// name, and personal flag. Version 0 values were encrypted without additional data.
+const currentSecretVersion = 1
+
+// secretAdditionalData is the AES-GCM additional data that binds a value to where it is stored
+func secretAdditionalData(env, name string, personal bool) []byte {
+	return []byte(fmt.Sprintf("epicenv secret v%d\x00%s\x00%s\x00%t", currentSecretVersion, env, name, personal))
+}
+
+// encryptSecret encrypts a value bound to env, name, and personal
+func encryptSecret(symKey []byte, env, name string, personal bool, plaintext string) (EncryptedSecret, error) {
+	encrypted, err := encryptAESGCM(symKey, plaintext, secretAdditionalData(env, name, personal))
+	if err != nil {
+		return EncryptedSecret{}, err
+	}
+
+	return EncryptedSecret{
+		Name:     name,
+		Value:    encrypted,
+		Personal: personal,
+		Version:  currentSecretVersion,
+	}, nil
+}
+
+var ErrUnboundSecret = errors.New("value is not bound to where it is stored")
+
+// checkSecretBound refuses shared values older than the SecretsVersion of keysFile. Once every value was bound,
+// an unbound one can only have been copied in from another name or environment, e.g. from the git history.
+func checkSecretBound(keysFile *KeysFile, item EncryptedSecret) error {
+	if item.Personal || item.Version >= keysFile.SecretsVersion {
+		return nil
+	}
+	return fmt.Errorf("%w: %s has version %d, but every value was upgraded to version %d, it may have been copied from another variable", ErrUnboundSecret, item.Name, item.Version, keysFile.SecretsVersion)
+}
+
+// decryptSecret decrypts a value stored in env, checking that it is bound to where it is stored
+func decryptSecret(symKey []byte, env string, secret EncryptedSecret) (string, error) {
+	switch secret.Version {
+	case 0:
+		return decryptAESGCM(symKey, secret.Value, nil)
+	case currentSecretVersion:
+		return decryptAESGCM(symKey, secret.Value, secretAdditionalData(env, secret.Name, secret.Personal))
+	default:
+		return "", fmt.Errorf("unsupported secret version %d, you may need to update epicenv", secret.Version)
+	}
+}
+
+// Returns a base64 encoded string, and the algorithm that was used
+func encryptWithPublicKey(data []byte, publicKey string) (string, string, error) {
 	// Parse the public key
 	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	// Convert the SSH public key to a crypto/rsa PublicKey
 	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
 	if !ok {
-		return "", fmt.Errorf("SSH key is not an RSA key")
-	}
-	rsaPub, ok := cryptoPub.CryptoPublicKey().(*rsa.PublicKey)
-	if !ok {
-		return "", fmt.Errorf("SSH key is not an RSA key")
+		return "", "", fmt.Errorf("unsupported SSH key type %s", pub.Type())
 	}
 
-	// Encrypt the data
-	encryptedData, err := rsa.EncryptPKCS1v15(rand.Reader, rsaPub, data)
-	if err != nil {
-		return "", err
+	switch key := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		encryptedData, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, data, nil)
+		if err != nil {
+			return "", "", err
+		}
+		return base64.StdEncoding.EncodeToString(encryptedData), algorithmRSAOAEP, nil
+	case ed25519.PublicKey:
+		encryptedData, err := encryptWithX25519(data, key)
+		if err != nil {
+			return "", "", err
+		}
+		return base64.StdEncoding.EncodeToString(encryptedData), algorithmX25519, nil
+	default:
+		return "", "", fmt.Errorf("unsupported SSH key type %s", pub.Type())
 	}
-
-	return base64.StdEncoding.EncodeToString(encryptedData), nil
 }
 
-// decryptWithPrivateKey decrypts data using the private key in the keyPair.
-func decryptWithPrivateKey(encryptedData string, kp keyPair) ([]byte, error) {
-	privateKeyBytes, err := os.ReadFile(kp.privateKeyPath)
+// decryptWithPrivateKey decrypts data that was encrypted with algorithm using the private key in the keyPair.
+func decryptWithPrivateKey(encryptedData, algorithm string, kp keyPair) ([]byte, error) {
+	privateKey, err := parsePrivateKey(kp)
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(privateKeyBytes)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	decodedData, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return nil, err
 	}
 
-	var privateKey interface{}
-	if block.Type == "RSA PRIVATE KEY" {
-		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, err
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		switch algorithm {
+		case algorithmRSAOAEP:
+			return rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decodedData, nil)
+		case algorithmRSAPKCS1v15, "":
+			return rsa.DecryptPKCS1v15(rand.Reader, key, decodedData)
+		default:
+			return nil, fmt.Errorf("unsupported algorithm %s for an RSA key", algorithm)
 		}
-	} else if block.Type == "OPENSSH PRIVATE KEY" {
-		privateKey, err = ssh.ParseRawPrivateKey(privateKeyBytes)
+	case *ed25519.PrivateKey:
+		if algorithm != algorithmX25519 && algorithm != "" {
+			return nil, fmt.Errorf("unsupported algorithm %s for an Ed25519 key", algorithm)
+		}
+		return decryptWithX25519(decodedData, *key)
+	default:
+		return nil, fmt.Errorf("unsupported private key type")
+	}
+}
+
+// parsePrivateKey reads the private key in the keyPair, returning an *rsa.PrivateKey or *ed25519.PrivateKey
+func parsePrivateKey(kp keyPair) (interface{}, error) {
+	privateKeyBytes := kp.privateKeyContent
+	if privateKeyBytes == nil {
+		var err error
+		privateKeyBytes, err = os.ReadFile(kp.privateKeyPath)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		return nil, fmt.Errorf("unsupported private key type")
 	}
 
-	decodedData, err := base64.StdEncoding.DecodeString(encryptedData)
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	}
+
+	privateKey, err := ssh.ParseRawPrivateKey(privateKeyBytes)
+	var passphraseMissing *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseMissing) {
+		privateKey, err = parseEncryptedPrivateKey(privateKeyBytes, kp.privateKeyPath)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	switch key := privateKey.(type) {
-	case *rsa.PrivateKey:
-		return rsa.DecryptPKCS1v15(rand.Reader, key, decodedData)
-	case *ed25519.PrivateKey:
-		return nil, fmt.Errorf("decryption with Ed25519 is not supported")
+	case *rsa.PrivateKey, *ed25519.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		// PKCS#8 keys are not returned as a pointer
+		return &key, nil
 	default:
-		return nil, fmt.Errorf("unsupported private key type")
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
 	}
 }
 
+// encryptWithX25519 wraps data for an Ed25519 recipient: an ephemeral X25519 key is agreed with the
+// recipient's converted public key, HKDF-SHA256 derives an AES-256 key, and AES-GCM seals the data.
+// The result is ephemeral public key || nonce || ciphertext.
+func encryptWithX25519(data []byte, edPub ed25519.PublicKey) ([]byte, error) {
+	recipientPub, err := convertEd25519ToX25519(edPub)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPriv := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeralPriv); err != nil {
+		return nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(ephemeralPriv, recipientPub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := x25519WrapCipher(shared, ephemeralPub, recipientPub[:])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(ephemeralPub, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+// decryptWithX25519 reverses encryptWithX25519 using the recipient's Ed25519 private key
+func decryptWithX25519(encryptedData []byte, edPriv ed25519.PrivateKey) ([]byte, error) {
+	if len(encryptedData) < curve25519.PointSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	ephemeralPub, rest := encryptedData[:curve25519.PointSize], encryptedData[curve25519.PointSize:]
+
+	recipientPriv := convertEd25519PrivateToX25519(edPriv)
+	recipientPub, err := curve25519.X25519(recipientPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := curve25519.X25519(recipientPriv, ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := x25519WrapCipher(shared, ephemeralPub, recipientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// x25519WrapCipher derives the AES-GCM cipher from the ECDH shared secret, binding both public keys
+func x25519WrapCipher(shared, ephemeralPub, recipientPub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralPub...), recipientPub...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519WrapInfo)), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// convertEd25519ToX25519 maps an Ed25519 public key (Edwards y coordinate) to the
+// X25519 public key (Montgomery u coordinate) using u = (1 + y) / (1 - y) mod p
 func convertEd25519ToX25519(ed25519PubKey ed25519.PublicKey) ([32]byte, error) {
 	var x25519PubKey [32]byte
 
@@ -153,11 +336,38 @@ func convertEd25519ToX25519(ed25519PubKey ed25519.PublicKey) ([32]byte, error) {
 		return x25519PubKey, fmt.Errorf("invalid Ed25519 public key size")
 	}
 
-	// The conversion is simply copying the key, as the underlying curve is the same
-	copy(x25519PubKey[:], ed25519PubKey)
+	// The key is little endian y with the sign of x in the top bit, which we don't need
+	yBytes := make([]byte, ed25519.PublicKeySize)
+	for i, b := range ed25519PubKey {
+		yBytes[len(yBytes)-1-i] = b
+	}
+	yBytes[0] &= 0x7F
+	y := new(big.Int).SetBytes(yBytes)
+
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return x25519PubKey, fmt.Errorf("invalid Ed25519 public key")
+	}
+	denominator.ModInverse(denominator, curve25519P)
 
-	// Clear the top bit
-	x25519PubKey[31] &= 0x7F
+	u := numerator.Mul(numerator, denominator)
+	u.Mod(u, curve25519P)
+
+	// Back to little endian
+	uBytes := u.FillBytes(make([]byte, 32))
+	for i, b := range uBytes {
+		x25519PubKey[len(uBytes)-1-i] = b
+	}
 
 	return x25519PubKey, nil
 }
+
+// convertEd25519PrivateToX25519 derives the X25519 scalar from an Ed25519 private key,
+// which is the first half of the SHA-512 hash of the seed (X25519 handles the clamping)
+func convertEd25519PrivateToX25519(ed25519PrivKey ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(ed25519PrivKey.Seed())
+	return h[:curve25519.ScalarSize]
+}
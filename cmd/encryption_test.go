@@ -2,9 +2,19 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
 )
 
 // TestEncryptDecrypt tests the encryption and decryption process with RSA and ED25519 keys.
@@ -22,12 +32,15 @@ func TestEncryptionDecryption(t *testing.T) {
 	testData := []byte("Hello, World!")
 
 	// Test RSA encryption and decryption
-	encryptedRSA, err := encryptWithPublicKey(testData, rsaKeyPair.publicKeyContent)
+	encryptedRSA, algorithm, err := encryptWithPublicKey(testData, rsaKeyPair.publicKeyContent)
 	if err != nil {
 		t.Fatalf("Failed to encrypt with RSA key: %v", err)
 	}
+	if algorithm != algorithmRSAOAEP {
+		t.Fatalf("expected new RSA keys to be wrapped with %s, got %s", algorithmRSAOAEP, algorithm)
+	}
 
-	decryptedRSA, err := decryptWithPrivateKey(encryptedRSA, rsaKeyPair)
+	decryptedRSA, err := decryptWithPrivateKey(encryptedRSA, algorithm, rsaKeyPair)
 	if err != nil {
 		t.Fatalf("Failed to decrypt with RSA key: %v", err)
 	}
@@ -35,6 +48,25 @@ func TestEncryptionDecryption(t *testing.T) {
 	if !bytes.Equal(testData, decryptedRSA) {
 		t.Errorf("RSA decrypted data does not match original data")
 	}
+
+	// Legacy PKCS#1 v1.5 entries have no algorithm and must still decrypt
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(rsaContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyData, err := rsa.EncryptPKCS1v15(rand.Reader, pub.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey), testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decryptedLegacy, err := decryptWithPrivateKey(base64.StdEncoding.EncodeToString(legacyData), "", rsaKeyPair)
+	if err != nil {
+		t.Fatalf("Failed to decrypt legacy RSA data: %v", err)
+	}
+
+	if !bytes.Equal(testData, decryptedLegacy) {
+		t.Errorf("Legacy RSA decrypted data does not match original data")
+	}
 }
 
 func TestEncryptDecryptAESGCM(t *testing.T) {
@@ -42,13 +74,13 @@ func TestEncryptDecryptAESGCM(t *testing.T) {
 	plaintext := "Hello, World!"
 
 	// Encrypt the plaintext
-	ciphertextBase64, err := encryptAESGCM(key, plaintext)
+	ciphertextBase64, err := encryptAESGCM(key, plaintext, nil)
 	if err != nil {
 		t.Fatalf("encryption failed: %v", err)
 	}
 
 	// Decrypt the ciphertext
-	decryptedText, err := decryptAESGCM(key, ciphertextBase64)
+	decryptedText, err := decryptAESGCM(key, ciphertextBase64, nil)
 	if err != nil {
 		t.Fatalf("decryption failed: %v", err)
 	}
@@ -58,3 +90,179 @@ func TestEncryptDecryptAESGCM(t *testing.T) {
 		t.Errorf("decryption result mismatch: got %q, want %q", decryptedText, plaintext)
 	}
 }
+
+func TestEd25519EncryptionDecryption(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(privateKeyPath, pem.EncodeToMemory(pemBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	edKeyPair := keyPair{
+		publicKeyContent: string(ssh.MarshalAuthorizedKey(sshPub)),
+		privateKeyPath:   privateKeyPath,
+	}
+
+	testData := []byte("Hello, World!")
+
+	encrypted, algorithm, err := encryptWithPublicKey(testData, edKeyPair.publicKeyContent)
+	if err != nil {
+		t.Fatalf("Failed to encrypt with Ed25519 key: %v", err)
+	}
+
+	decrypted, err := decryptWithPrivateKey(encrypted, algorithm, edKeyPair)
+	if err != nil {
+		t.Fatalf("Failed to decrypt with Ed25519 key: %v", err)
+	}
+
+	if !bytes.Equal(testData, decrypted) {
+		t.Errorf("Ed25519 decrypted data does not match original data")
+	}
+}
+
+func TestConvertEd25519ToX25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		converted, err := convertEd25519ToX25519(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The converted public key must match the public key of the converted private key
+		expected, err := curve25519.X25519(convertEd25519PrivateToX25519(priv), curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(converted[:], expected) {
+			t.Fatalf("converted public key mismatch: got %x, want %x", converted, expected)
+		}
+	}
+}
+
+func TestSecretBinding(t *testing.T) {
+	key := generateAESKey()
+
+	secret, err := encryptSecret(key, "prod", "STRIPE_SECRET", false, "sk_live_123")
+	if err != nil {
+		t.Fatalf("encryption failed: %v", err)
+	}
+
+	decrypted, err := decryptSecret(key, "prod", secret)
+	if err != nil {
+		t.Fatalf("decryption failed: %v", err)
+	}
+	if decrypted != "sk_live_123" {
+		t.Errorf("decryption result mismatch: got %q", decrypted)
+	}
+
+	// Moving the ciphertext to another name, environment, or personal flag must fail
+	moved := secret
+	moved.Name = "LOG_LEVEL"
+	if _, err := decryptSecret(key, "prod", moved); err == nil {
+		t.Error("decrypted a value moved to another name")
+	}
+	if _, err := decryptSecret(key, "staging", secret); err == nil {
+		t.Error("decrypted a value moved to another environment")
+	}
+	moved = secret
+	moved.Personal = true
+	if _, err := decryptSecret(key, "prod", moved); err == nil {
+		t.Error("decrypted a value with a flipped personal flag")
+	}
+
+	// Downgrading to an unbound version must fail too
+	moved = secret
+	moved.Version = 0
+	if _, err := decryptSecret(key, "prod", moved); err == nil {
+		t.Error("decrypted a bound value as unbound")
+	}
+
+	// Legacy values still decrypt
+	legacy, err := encryptAESGCM(key, "info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err = decryptSecret(key, "prod", EncryptedSecret{Name: "LOG_LEVEL", Value: legacy})
+	if err != nil {
+		t.Fatalf("legacy decryption failed: %v", err)
+	}
+	if decrypted != "info" {
+		t.Errorf("legacy decryption result mismatch: got %q", decrypted)
+	}
+
+	// Until migrate records that every value was bound
+	legacySecret := EncryptedSecret{Name: "LOG_LEVEL", Value: legacy}
+	if err := checkSecretBound(&KeysFile{}, legacySecret); err != nil {
+		t.Errorf("legacy value refused before migrating: %v", err)
+	}
+	bound := &KeysFile{SecretsVersion: currentSecretVersion}
+	if err := checkSecretBound(bound, legacySecret); !errors.Is(err, ErrUnboundSecret) {
+		t.Errorf("legacy value after migrating: err = %v, want ErrUnboundSecret", err)
+	}
+	if err := checkSecretBound(bound, secret); err != nil {
+		t.Errorf("bound value refused: %v", err)
+	}
+}
+
+func TestPassphraseProtectedKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(privateKeyPath, pem.EncodeToMemory(pemBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	edKeyPair := keyPair{
+		publicKeyContent: string(ssh.MarshalAuthorizedKey(sshPub)),
+		privateKeyPath:   privateKeyPath,
+	}
+
+	testData := []byte("Hello, World!")
+	encrypted, algorithm, err := encryptWithPublicKey(testData, edKeyPair.publicKeyContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("EPICENV_SSH_PASSPHRASE", "wrong")
+	if _, err := decryptWithPrivateKey(encrypted, algorithm, edKeyPair); err == nil {
+		t.Fatal("decrypted with the wrong passphrase")
+	}
+
+	t.Setenv("EPICENV_SSH_PASSPHRASE", "correct horse")
+	decrypted, err := decryptWithPrivateKey(encrypted, algorithm, edKeyPair)
+	if err != nil {
+		t.Fatalf("Failed to decrypt with passphrase protected key: %v", err)
+	}
+
+	if !bytes.Equal(testData, decrypted) {
+		t.Errorf("decrypted data does not match original data")
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
@@ -44,12 +46,22 @@ func getEnvOrFlag(cmd *cobra.Command) string {
 type loadedEnvVar struct {
 	Value    string
 	Personal bool
+	// NeedsRotation is whether someone who could read the value was uninvited since it was set
+	NeedsRotation bool
 }
 
 // loadEnv will short circuit fatal exit if it has an unrecoverable error.
 // For overlay environments, it loads and merges secrets through the entire chain.
 func loadEnv(env string) map[string]loadedEnvVar {
-	symKey, err := loadSymmetricKey(env)
+	// The key, groups and expiry only come from a keys.json we trust
+	keysFile := verifyEnvSignatures(env)
+
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	symKey, err := unwrapCachedKey(env, rootEnv, keysFile)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error loading symmetric key")
 	}
@@ -60,11 +72,35 @@ func loadEnv(env string) map[string]loadedEnvVar {
 		logger.Fatal().Err(err).Msg("error getting overlay chain")
 	}
 
+	groupKeys := newGroupKeyring(keysFile)
+
+	if expired := expiredUsers(keysFile, time.Now()); len(expired) > 0 {
+		logger.Warn().Msgf("Expired invites can still decrypt %s: %s, an admin should run 'epicenv prune-expired'", rootEnv, strings.Join(expired, ", "))
+	}
+
 	envMap := make(map[string]loadedEnvVar)
+	// Values in groups we are not a member of, by name
+	skipped := make(map[string]string)
 
 	// Load and merge secrets from each environment in the chain
 	for _, chainEnv := range chain {
-		loadEnvLayer(chainEnv, symKey, envMap)
+		loadEnvLayer(chainEnv, symKey, keysFile, groupKeys, envMap, skipped)
+	}
+
+	if len(skipped) > 0 {
+		names := lo.Keys(skipped)
+		slices.Sort(names)
+		logger.Warn().Msgf("Skipped values in groups you are not a member of: %s", strings.Join(lo.Map(names, func(name string, index int) string {
+			return fmt.Sprintf("%s (%s)", name, skipped[name])
+		}), ", "))
+	}
+
+	needsRotation := lo.Keys(lo.PickBy(envMap, func(key string, value loadedEnvVar) bool {
+		return value.NeedsRotation
+	}))
+	if len(needsRotation) > 0 {
+		slices.Sort(needsRotation)
+		logger.Warn().Msgf("Values that someone who was uninvited could read, change them where they come from and set them again: %s", strings.Join(needsRotation, ", "))
 	}
 
 	// Find any that we didn't fill in from personal secrets and warn
@@ -79,8 +115,10 @@ func loadEnv(env string) map[string]loadedEnvVar {
 }
 
 // loadEnvLayer loads secrets from a single environment and merges them into envMap.
-// Later layers override earlier ones.
-func loadEnvLayer(env string, symKey []byte, envMap map[string]loadedEnvVar) {
+// Later layers override earlier ones. Values in groups we can't decrypt are removed from envMap and added to skipped.
+// Values still encrypted with a previous key, because a rotation stopped before re-encrypting them, are decrypted
+// with it.
+func loadEnvLayer(env string, symKey []byte, keysFile *KeysFile, groupKeys *groupKeyring, envMap map[string]loadedEnvVar, skipped map[string]string) {
 	secretsFile, err := readSecretsFile(env, false)
 	if errors.Is(err, os.ErrNotExist) {
 		return
@@ -92,6 +130,15 @@ func loadEnvLayer(env string, symKey []byte, envMap map[string]loadedEnvVar) {
 	// Track which keys are personal in this layer (need personal values)
 	var personalKeys []string
 
+	legacy := lo.CountBy(secretsFile.Secrets, func(item EncryptedSecret) bool {
+		return !item.Personal && item.Version < currentSecretVersion
+	})
+	if legacy > 0 && keysFile.SecretsVersion < currentSecretVersion {
+		logger.Warn().Msgf("%d values in %s are not bound to their names, run 'epicenv migrate' to upgrade them", legacy, env)
+	}
+
+	layerKeys := &envKeyring{env: env, keysFile: keysFile, symKey: symKey, groupKeys: groupKeys}
+	var stale []string
 	for _, item := range secretsFile.Secrets {
 		if item.Personal {
 			personalKeys = append(personalKeys, item.Name)
@@ -103,15 +150,44 @@ func loadEnvLayer(env string, symKey []byte, envMap map[string]loadedEnvVar) {
 				}
 			}
 		} else {
-			decrypted, err := decryptAESGCM(symKey, item.Value)
+			if err := checkSecretBound(keysFile, item); err != nil {
+				logger.Fatal().Err(err).Msgf("Refusing to load %s, set the value again if it is right", env)
+			}
+
+			valueKey := symKey
+			if item.Group != "" {
+				valueKey, err = groupKeys.key(item.Group)
+				if errors.Is(err, ErrNotGroupMember) || errors.Is(err, ErrGroupNotFound) {
+					delete(envMap, item.Name)
+					skipped[item.Name] = item.Group
+					continue
+				}
+				if err != nil {
+					logger.Fatal().Err(err).Msgf("error decrypting the key of group %s for %s", item.Group, item.Name)
+				}
+			}
+
+			decrypted, err := decryptSecret(valueKey, env, item)
+			if err != nil && item.Group == "" {
+				if value, _, ok := layerKeys.decrypt(item); ok {
+					decrypted, err = value, nil
+					stale = append(stale, item.Name)
+				}
+			}
 			if err != nil {
 				logger.Fatal().Err(err).Msgf("error decrypting shared environment variable %s", item.Name)
 			}
 			envMap[item.Name] = loadedEnvVar{
-				Value:    decrypted,
-				Personal: false,
+				Value:         decrypted,
+				Personal:      false,
+				NeedsRotation: item.NeedsRotation,
 			}
 		}
+		delete(skipped, item.Name)
+	}
+
+	if len(stale) > 0 {
+		logger.Warn().Msgf("Values in %s are still encrypted with a previous key, run 'epicenv rotate-key' to finish rotating it: %s", env, strings.Join(stale, ", "))
 	}
 
 	// Load personal secrets for this layer
@@ -122,8 +198,13 @@ func loadEnvLayer(env string, symKey []byte, envMap map[string]loadedEnvVar) {
 		}
 
 		if personalSecretsFile != nil {
+			err = migratePersonalSecrets(env, personalSecretsFile, symKey)
+			if err != nil {
+				logger.Fatal().Err(err).Msgf("error migrating personal secrets for %s to the current key", env)
+			}
+
 			for _, item := range personalSecretsFile.Secrets {
-				decrypted, err := decryptAESGCM(symKey, item.Value)
+				decrypted, err := decryptSecret(symKey, env, item)
 				if err != nil {
 					logger.Fatal().Err(err).Msgf("error decrypting personal environment variable %s", item.Name)
 				}
@@ -151,29 +232,201 @@ func loadSymmetricKey(env string) ([]byte, error) {
 		return nil, fmt.Errorf("error reading keys file: %w", err)
 	}
 
-	keyPairs := findPrivateKeysForPublicKeys(lo.Map(keysFile.EncryptedKeys, func(item EncryptedKey, index int) string {
+	return unwrapCachedKey(env, rootEnv, keysFile)
+}
+
+// unwrapCachedKey returns the symmetric key of keysFile from the agent if it has it, otherwise it unwraps it and
+// caches it in the agent
+func unwrapCachedKey(env, rootEnv string, keysFile *KeysFile) ([]byte, error) {
+	agentKey := agentCacheKey(rootEnv, keysFile)
+	if symKey, found := agentGet(agentKey, rootEnv); found {
+		logger.Debug().Msgf("Using key for %s from agent", rootEnv)
+		return symKey, nil
+	}
+
+	symKey, err := unwrapSymmetricKey(env, keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	agentPut(agentKey, rootEnv, symKey)
+
+	return symKey, nil
+}
+
+// unwrapSymmetricKey decrypts the symmetric key in keysFile with the first matching local private key that works
+func unwrapSymmetricKey(env string, keysFile *KeysFile) ([]byte, error) {
+	if keysFile.Version < currentKeysFileVersion {
+		logger.Warn().Msg("keys.json contains legacy RSA PKCS#1 v1.5 wrapped keys, run 'epicenv migrate' to upgrade them")
+	}
+
+	symKey, err := unwrapWithLocalKeys(keysFile.EncryptedKeys)
+	if errors.Is(err, ErrNoLocalKey) {
+		return nil, fmt.Errorf("did not find any local private keys matching a known public key, are you invited to the %s environment?", env)
+	}
+
+	return symKey, err
+}
+
+// unwrapWithLocalKeys decrypts the key in encryptedKeys with the first matching local private key that works
+func unwrapWithLocalKeys(encryptedKeys []EncryptedKey) ([]byte, error) {
+	keyPairs := findPrivateKeysForPublicKeys(lo.Map(encryptedKeys, func(item EncryptedKey, index int) string {
 		return item.PublicKey
 	}))
 
 	if len(keyPairs) == 0 {
-		return nil, fmt.Errorf("did not find any local private keys matching a known public key, are you invited to the %s environment?", env)
+		return nil, ErrNoLocalKey
 	}
 
-	// Use the first one we found
-	chosenKey := keyPairs[0]
+	// Try each key we found until one works, e.g. if the passphrase for one is unknown
+	var err error
+	for _, chosenKey := range keyPairs {
+		// decrypt symmetric key
+		actualKey, found := lo.Find(encryptedKeys, func(item EncryptedKey) bool {
+			return item.PublicKey == chosenKey.publicKeyContent
+		})
+		if !found {
+			return nil, fmt.Errorf("did not find the known public key again among the encrypted keys, this is a bug. Please report")
+		}
+
+		var symKey []byte
+		symKey, err = decryptWithPrivateKey(actualKey.EncryptedSharedKey, actualKey.Algorithm, chosenKey)
+		if err == nil {
+			return symKey, nil
+		}
+		logger.Debug().Err(err).Msgf("Could not decrypt with %s", chosenKey.privateKeyPath)
+	}
 
-	// decrypt symmetric key
-	actualKey, found := lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
-		return item.PublicKey == chosenKey.publicKeyContent
+	return nil, err
+}
+
+// previousSymmetricKey decrypts the symmetric key for an older generation using the current symmetric key
+func previousSymmetricKey(keysFile *KeysFile, symKey []byte, generation int) ([]byte, error) {
+	previous, found := lo.Find(keysFile.PreviousKeys, func(item PreviousKey) bool {
+		return item.Generation == generation
 	})
 	if !found {
-		return nil, fmt.Errorf("did not find the known public key again among the encrypted keys, this is a bug. Please report")
+		return nil, fmt.Errorf("no previous key for generation %d", generation)
 	}
 
-	symKey, err := decryptWithPrivateKey(actualKey.EncryptedSharedKey, chosenKey)
+	decrypted, err := decryptAESGCM(symKey, previous.EncryptedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting previous key for generation %d: %w", generation, err)
+	}
+
+	return []byte(decrypted), nil
+}
+
+// migratePersonalSecrets re-encrypts personal secrets that were encrypted before the last symmetric key rotation.
+// personalSecretsFile is updated in place and written back if anything changed.
+func migratePersonalSecrets(env string, personalSecretsFile *SecretsFile, symKey []byte) error {
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		return fmt.Errorf("error resolving root environment: %w", err)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	if personalSecretsFile.Generation == keysFile.Generation {
+		return nil
+	}
+
+	logger.Debug().Msgf("Migrating personal secrets for %s from generation %d to %d", env, personalSecretsFile.Generation, keysFile.Generation)
+
+	var oldKey []byte
+	if len(personalSecretsFile.Secrets) > 0 {
+		oldKey, err = previousSymmetricKey(keysFile, symKey, personalSecretsFile.Generation)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, item := range personalSecretsFile.Secrets {
+		decrypted, err := decryptSecret(oldKey, env, item)
+		if err != nil {
+			return fmt.Errorf("error decrypting personal environment variable %s: %w", item.Name, err)
+		}
+		personalSecretsFile.Secrets[i], err = encryptSecret(symKey, env, item.Name, item.Personal, decrypted)
+		if err != nil {
+			return fmt.Errorf("error encrypting personal environment variable %s: %w", item.Name, err)
+		}
+	}
+	personalSecretsFile.Generation = keysFile.Generation
+
+	err = writeSecretsFile(env, *personalSecretsFile, true)
+	if err != nil {
+		return fmt.Errorf("error writing personal secrets file: %w", err)
+	}
+
+	if len(personalSecretsFile.Secrets) > 0 {
+		logger.Info().Msgf("Migrated %d personal secrets in %s to the rotated key", len(personalSecretsFile.Secrets), env)
+	}
+
+	return nil
+}
+
+// envKeyring decrypts the shared values of an environment with our keys, including values encrypted with a previous
+// generation of its key, such as values from older commits or other branches
+type envKeyring struct {
+	env       string
+	keysFile  *KeysFile
+	symKey    []byte
+	groupKeys *groupKeyring
+}
+
+func loadEnvKeyring(env string) (*envKeyring, error) {
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving root environment: %w", err)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	symKey, err := loadSymmetricKey(env)
 	if err != nil {
 		return nil, err
 	}
 
-	return symKey, nil
+	return &envKeyring{env: env, keysFile: keysFile, symKey: symKey, groupKeys: newGroupKeyring(keysFile)}, nil
+}
+
+// decrypt decrypts item with the current key, its group's key, or a previous key, in which case it is stale.
+// The last result is false if we can't decrypt it, which is always the case for the personal placeholders in
+// secrets.json, personal values from personal_secrets.json can be decrypted.
+func (k *envKeyring) decrypt(item EncryptedSecret) (string, bool, bool) {
+	if k == nil || item.Personal && item.Value == "" {
+		return "", false, false
+	}
+
+	if item.Group != "" {
+		groupKey, err := k.groupKeys.key(item.Group)
+		if err != nil {
+			return "", false, false
+		}
+		value, err := decryptSecret(groupKey, k.env, item)
+		return value, false, err == nil
+	}
+
+	if value, err := decryptSecret(k.symKey, k.env, item); err == nil {
+		return value, false, true
+	}
+
+	for _, previous := range k.keysFile.PreviousKeys {
+		previousKey, err := previousSymmetricKey(k.keysFile, k.symKey, previous.Generation)
+		if err != nil {
+			continue
+		}
+		if value, err := decryptSecret(previousKey, k.env, item); err == nil {
+			return value, true, true
+		}
+	}
+
+	return "", false, false
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// expiresNever removes the expiry of an invited user
+const expiresNever = "never"
+
+// parseExpiresIn parses how long an invite lasts, e.g. 30d, 2w, or a Go duration like 12h
+func parseExpiresIn(s string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry %q, use e.g. 30d, 2w or 12h", s)
+		}
+		if d <= 0 {
+			return 0, fmt.Errorf("expiry %q must be in the future", s)
+		}
+		return d, nil
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry %q, use e.g. 30d, 2w or 12h", s)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("expiry %q must be in the future", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// expiresAt returns when an invite made now expires, nil for an empty expiresIn or never
+func expiresAt(expiresIn string, now time.Time) (*time.Time, error) {
+	if expiresIn == "" || expiresIn == expiresNever {
+		return nil, nil
+	}
+
+	d, err := parseExpiresIn(expiresIn)
+	if err != nil {
+		return nil, err
+	}
+	return lo.ToPtr(now.Add(d).UTC().Truncate(time.Second)), nil
+}
+
+// isExpired checks whether the invite of key expired before now
+func isExpired(key EncryptedKey, now time.Time) bool {
+	return key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)
+}
+
+// userExpiresAt returns when the invite of username expires, nil if it doesn't
+func userExpiresAt(keysFile *KeysFile, username string) *time.Time {
+	key, _ := lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+		return item.Username == username
+	})
+	return key.ExpiresAt
+}
+
+// expiredUsers returns the users and headless keys whose invites expired before now
+func expiredUsers(keysFile *KeysFile, now time.Time) []string {
+	return lo.Uniq(lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+		return item.Username, isExpired(item, now)
+	}))
+}
+
+// formatExpiry describes when the invite of username expires for list-invites, empty if it doesn't
+func formatExpiry(keysFile *KeysFile, username string, now time.Time) string {
+	at := userExpiresAt(keysFile, username)
+	if at == nil {
+		return ""
+	}
+	if !now.Before(*at) {
+		return fmt.Sprintf(" EXPIRED %s", at.Local().Format(time.DateOnly))
+	}
+	return fmt.Sprintf(" expires %s", at.Local().Format(time.DateOnly))
+}
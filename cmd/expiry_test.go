@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresIn(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		got, err := parseExpiresIn(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %s, want %s", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "d", "xd", "0d", "-1h", "1y"} {
+		if _, err := parseExpiresIn(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestExpiredUsers(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	keysFile := &KeysFile{
+		EncryptedKeys: []EncryptedKey{
+			{Username: "alice"},
+			{Username: "contractor", ExpiresAt: &past},
+			{Username: "contractor", ExpiresAt: &past},
+			{Username: "preview-ci", ExpiresAt: &future, IsHeadless: true},
+		},
+	}
+
+	if got := expiredUsers(keysFile, now); !reflect.DeepEqual(got, []string{"contractor"}) {
+		t.Fatalf("unexpected expired users %v", got)
+	}
+	if got := expiredUsers(keysFile, future); !reflect.DeepEqual(got, []string{"contractor", "preview-ci"}) {
+		t.Fatalf("unexpected expired users %v", got)
+	}
+
+	at, err := expiresAt(expiresNever, now)
+	if err != nil || at != nil {
+		t.Fatalf("expected no expiry for never, got %v, %v", at, err)
+	}
+	at, err = expiresAt("1d", now)
+	if err != nil || !at.Equal(now.Add(24*time.Hour)) {
+		t.Fatalf("unexpected expiry %v, %v", at, err)
+	}
+}
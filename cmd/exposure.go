@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// exposureCmd represents the exposure command
+var exposureCmd = &cobra.Command{
+	Use:   "exposure USER",
+	Short: "List the values a user could have decrypted that are still in use",
+	Long: `List the shared values that a user or headless key could have decrypted, and that still have the same value.
+
+Walks the git history of keys.json and the secrets.json of the root environment and every overlay on top
+of it. Whenever the user had a wrapped key, they could decrypt every value encrypted with that key or an
+older one, including older values they could find in the git history, and the values of the groups they
+were in. Those values should be changed where they come from, then set again.
+
+Changes that are not committed yet are included.
+
+Examples:
+  epicenv exposure alice -e prod
+  epicenv exposure gitlab:bob`,
+	Run:  runExposure,
+	Args: cobra.ExactArgs(1),
+}
+
+func init() {
+	rootCmd.AddCommand(exposureCmd)
+}
+
+type (
+	// exposureSnapshot is the keys and shared secrets of an environment and its overlays at one commit
+	exposureSnapshot struct {
+		// Commit is empty for the working tree
+		Commit  gitCommit
+		Keys    *KeysFile
+		Secrets map[string]*SecretsFile
+	}
+
+	// exposure is a value that is still in use, which a user could have decrypted
+	exposure struct {
+		Env  string
+		Name string
+		// Since is the first commit with the value they could decrypt, empty if it is not committed yet
+		Since gitCommit
+	}
+
+	// valueDecrypter decrypts a value from a snapshot, false if we can't
+	valueDecrypter func(snapshot *exposureSnapshot, env string, item EncryptedSecret) (string, bool)
+)
+
+func runExposure(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	username := args[0]
+	if normalized, err := normalizeUserSpec(username); err == nil {
+		username = normalized
+	}
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Checking root environment '%s' and every overlay on top of it", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	environments, err := getEnvironmentsForRoot(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error finding overlays of %s", rootEnv)
+	}
+
+	snapshots, err := loadExposureSnapshots(rootEnv, environments)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading the git history, is the .epicenv directory in a git repository?")
+	}
+	logger.Debug().Msgf("Checking %d commits", len(snapshots)-1)
+
+	// Values are decrypted with the key they were encrypted with, so we can tell if they changed after a rotation
+	groupKeys := newGroupKeyring(keysFile)
+	decrypt := func(snapshot *exposureSnapshot, env string, item EncryptedSecret) (string, bool) {
+		var valueKey []byte
+		var err error
+		switch {
+		case item.Group != "":
+			valueKey, err = groupKeys.key(item.Group)
+		case snapshot.Keys.Generation == keysFile.Generation:
+			valueKey = symKey
+		default:
+			valueKey, err = previousSymmetricKey(keysFile, symKey, snapshot.Keys.Generation)
+		}
+		if err != nil {
+			return "", false
+		}
+
+		decrypted, err := decryptSecret(valueKey, env, item)
+		if err != nil {
+			return "", false
+		}
+		return decrypted, true
+	}
+
+	if userRole(keysFile, username) != "" {
+		logger.Warn().Msgf("'%s' is still invited to %s, they can decrypt every value", username, rootEnv)
+	}
+
+	exposures := findExposures(snapshots, username, decrypt)
+	if len(exposures) == 0 {
+		logger.Info().Msgf("'%s' could not decrypt any of the values in use in %s", username, rootEnv)
+		return
+	}
+
+	logger.Info().Msgf("'%s' could decrypt %d values that are still in use:", username, len(exposures))
+	for _, item := range exposures {
+		if item.Since.Hash == "" {
+			logger.Info().Msgf("- %s in %s, not committed yet", item.Name, item.Env)
+			continue
+		}
+		logger.Info().Msgf("- %s in %s, since %.8s (%s)", item.Name, item.Env, item.Since.Hash, item.Since.Time.Format("2006-01-02"))
+	}
+	logger.Warn().Msg("Change these values where they come from, then set them again")
+}
+
+// loadExposureSnapshots loads the keys and shared secrets of rootEnv and environments at every commit that changed them, oldest first.
+// The last snapshot is the working tree.
+func loadExposureSnapshots(rootEnv string, environments []string) ([]exposureSnapshot, error) {
+	epicEnvPath := getEpicEnvPath()
+	keysPath := path.Join(rootEnv, "keys.json")
+	secretsPaths := lo.SliceToMap(environments, func(env string) (string, string) {
+		return env, path.Join(env, "secrets.json")
+	})
+
+	commits, err := gitLog(epicEnvPath, append([]string{keysPath}, lo.Values(secretsPaths)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []exposureSnapshot
+	for _, commit := range commits {
+		keysBytes, err := gitShow(epicEnvPath, commit.Hash, keysPath)
+		if errors.Is(err, os.ErrNotExist) {
+			// The environment didn't exist yet
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot := exposureSnapshot{Commit: commit, Keys: &KeysFile{}, Secrets: make(map[string]*SecretsFile)}
+		err = json.Unmarshal(keysBytes, snapshot.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s in %s: %w", keysPath, commit.Hash, err)
+		}
+
+		for env, secretsPath := range secretsPaths {
+			secretsBytes, err := gitShow(epicEnvPath, commit.Hash, secretsPath)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var secretsFile SecretsFile
+			err = json.Unmarshal(secretsBytes, &secretsFile)
+			if err != nil {
+				return nil, fmt.Errorf("error unmarshalling %s in %s: %w", secretsPath, commit.Hash, err)
+			}
+			snapshot.Secrets[env] = &secretsFile
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+	current := exposureSnapshot{Keys: keysFile, Secrets: make(map[string]*SecretsFile)}
+	for _, env := range environments {
+		secretsFile, err := readSecretsFile(env, false)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading secrets file for %s: %w", env, err)
+		}
+		current.Secrets[env] = secretsFile
+	}
+
+	return append(snapshots, current), nil
+}
+
+// findExposures finds the values in the last snapshot that username could decrypt in any of the snapshots.
+// Values we can't decrypt are compared by their encrypted values.
+func findExposures(snapshots []exposureSnapshot, username string, decrypt valueDecrypter) []exposure {
+	isUser := func(item EncryptedKey) bool {
+		return item.Username == username
+	}
+
+	// Older keys are encrypted with newer ones, so they could decrypt anything encrypted with an older generation than
+	// the newest one they had. Group keys are never rotated, so they can decrypt a group's values once they were in it.
+	heldGeneration := -1
+	heldGroups := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		if lo.ContainsBy(snapshot.Keys.EncryptedKeys, isUser) {
+			heldGeneration = max(heldGeneration, snapshot.Keys.Generation)
+		}
+		for _, group := range snapshot.Keys.Groups {
+			if lo.ContainsBy(group.EncryptedKeys, isUser) {
+				heldGroups[group.Name] = true
+			}
+		}
+	}
+
+	readable := func(snapshot *exposureSnapshot, item EncryptedSecret) bool {
+		if item.Personal {
+			// Personal values never leave the machine they were set on
+			return false
+		}
+		if item.Group != "" {
+			return heldGroups[item.Group]
+		}
+		return snapshot.Keys.Generation <= heldGeneration
+	}
+	valueOf := func(snapshot *exposureSnapshot, env string, item EncryptedSecret) string {
+		if decrypted, ok := decrypt(snapshot, env, item); ok {
+			return decrypted
+		}
+		return item.Value
+	}
+
+	type readValue struct {
+		value string
+		since gitCommit
+	}
+
+	// Every value they could read, by environment and name
+	read := make(map[string]map[string][]readValue)
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		for env, secretsFile := range snapshot.Secrets {
+			if read[env] == nil {
+				read[env] = make(map[string][]readValue)
+			}
+			for _, item := range secretsFile.Secrets {
+				if !readable(snapshot, item) {
+					continue
+				}
+
+				value := valueOf(snapshot, env, item)
+				if !lo.ContainsBy(read[env][item.Name], func(seen readValue) bool {
+					return seen.value == value
+				}) {
+					read[env][item.Name] = append(read[env][item.Name], readValue{value: value, since: snapshot.Commit})
+				}
+			}
+		}
+	}
+
+	current := &snapshots[len(snapshots)-1]
+	envs := lo.Keys(current.Secrets)
+	slices.Sort(envs)
+
+	var exposures []exposure
+	for _, env := range envs {
+		for _, item := range current.Secrets[env].Secrets {
+			if item.Personal {
+				continue
+			}
+
+			value := valueOf(current, env, item)
+			seen, found := lo.Find(read[env][item.Name], func(seen readValue) bool {
+				return seen.value == value
+			})
+			if found {
+				exposures = append(exposures, exposure{Env: env, Name: item.Name, Since: seen.since})
+			}
+		}
+	}
+
+	return exposures
+}
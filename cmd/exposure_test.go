@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindExposures(t *testing.T) {
+	keys := func(generation int, usernames ...string) *KeysFile {
+		keysFile := &KeysFile{Generation: generation}
+		for _, username := range usernames {
+			keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, EncryptedKey{Username: username})
+		}
+		return keysFile
+	}
+	secrets := func(items ...EncryptedSecret) map[string]*SecretsFile {
+		return map[string]*SecretsFile{"local": {Secrets: items}}
+	}
+	// Values are "plaintext@generation", so rotating changes the encrypted value but not the plaintext
+	decrypt := func(snapshot *exposureSnapshot, env string, item EncryptedSecret) (string, bool) {
+		return item.Value[:len(item.Value)-2], true
+	}
+
+	withOps := keys(0, "me", "alice")
+	withOps.Groups = []Group{{Name: "ops", EncryptedKeys: []EncryptedKey{{Username: "alice"}}}}
+
+	snapshots := []exposureSnapshot{
+		// Before alice was invited
+		{Commit: gitCommit{Hash: "a"}, Keys: keys(0, "me"), Secrets: secrets(
+			EncryptedSecret{Name: "OLD", Value: "old@0"},
+		)},
+		{Commit: gitCommit{Hash: "b"}, Keys: withOps, Secrets: secrets(
+			EncryptedSecret{Name: "OLD", Value: "old@0"},
+			EncryptedSecret{Name: "DB", Value: "db1@0"},
+			EncryptedSecret{Name: "API", Value: "api1@0"},
+			EncryptedSecret{Name: "OPS", Value: "ops@0", Group: "ops"},
+			EncryptedSecret{Name: "MINE", Personal: true},
+		)},
+		// alice was uninvited, and the key was rotated
+		{Commit: gitCommit{Hash: "c"}, Keys: keys(1, "me"), Secrets: secrets(
+			EncryptedSecret{Name: "OLD", Value: "old@1"},
+			EncryptedSecret{Name: "DB", Value: "db1@1"},
+			EncryptedSecret{Name: "API", Value: "api1@1"},
+			EncryptedSecret{Name: "OPS", Value: "ops@0", Group: "ops"},
+			EncryptedSecret{Name: "MINE", Personal: true},
+		)},
+		// Working tree, API was changed after the rotation
+		{Keys: keys(1, "me"), Secrets: secrets(
+			EncryptedSecret{Name: "OLD", Value: "old@1"},
+			EncryptedSecret{Name: "DB", Value: "db1@1"},
+			EncryptedSecret{Name: "API", Value: "api2@1"},
+			EncryptedSecret{Name: "OPS", Value: "ops@0", Group: "ops"},
+			EncryptedSecret{Name: "NEW", Value: "new@1"},
+			EncryptedSecret{Name: "MINE", Personal: true},
+		)},
+	}
+
+	want := []exposure{
+		{Env: "local", Name: "OLD", Since: gitCommit{Hash: "a"}},
+		{Env: "local", Name: "DB", Since: gitCommit{Hash: "b"}},
+		{Env: "local", Name: "OPS", Since: gitCommit{Hash: "b"}},
+	}
+	if got := findExposures(snapshots, "alice", decrypt); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if got := findExposures(snapshots, "bob", decrypt); len(got) != 0 {
+		t.Fatalf("bob was never invited, got %+v", got)
+	}
+}
@@ -2,32 +2,128 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"time"
 )
 
 type (
 	KeysFile struct {
+		// Version is the keys file format, 0 means some keys may still use legacy wrapping
+		Version int `json:",omitempty"`
+		// SecretsVersion is the EncryptedSecret version every shared value was upgraded to, older values are refused
+		SecretsVersion int `json:",omitempty"`
+
+		EncryptedKeys []EncryptedKey
+
+		// Generation is incremented every time the symmetric key is rotated
+		Generation int `json:",omitempty"`
+		// PreviousKeys are the symmetric keys from older generations, encrypted with the current key,
+		// so that personal secrets encrypted before a rotation can be migrated
+		PreviousKeys []PreviousKey `json:",omitempty"`
+
+		// Groups have their own keys, for values that only some invitees should be able to decrypt
+		Groups []Group `json:",omitempty"`
+
+		// Split is the symmetric key split into shares held by some admins, see 'epicenv recovery split'
+		Split *SplitKey `json:",omitempty"`
+	}
+
+	SplitKey struct {
+		// Threshold is how many shares are needed to reconstruct the symmetric key
+		Threshold int
+		// Check is an empty value encrypted with the symmetric key, to tell if it was reconstructed correctly
+		Check string
+		// Shares has the share of each holder encrypted for every one of their keys
+		Shares []EncryptedKey
+	}
+
+	Group struct {
+		Name string
+		// EncryptedKeys has the group key encrypted for every key of every member
 		EncryptedKeys []EncryptedKey
 	}
 
+	PreviousKey struct {
+		Generation int
+		// EncryptedKey base64 encoded older symmetric key, encrypted with the current symmetric key
+		EncryptedKey string
+	}
+
 	EncryptedKey struct {
 		// GitHub username, there may be many for the same
 		Username  string
 		PublicKey string
+		// Fingerprint is the SHA256 fingerprint of PublicKey when it was invited
+		Fingerprint string `json:",omitempty"`
 
 		// EncryptedSharedKey base64 encoded encrypted bytes
 		EncryptedSharedKey string
+		// Algorithm used to encrypt the shared key, empty for legacy RSA PKCS#1 v1.5
+		Algorithm string `json:",omitempty"`
 
 		// IsHeadless indicates if this is a headless key (not associated with a GitHub user)
 		IsHeadless bool
+
+		// Role is admin, writer or reader, empty for keys invited before roles existed which are admins
+		Role string `json:",omitempty"`
+
+		// Team is the GitHub ORG/TEAM or ORG the user was invited through, so they can be synced with it
+		Team string `json:",omitempty"`
+
+		// ExpiresAt is when the invite expires, after which prune-expired removes it
+		ExpiresAt *time.Time `json:",omitempty"`
+
+		// IsRecovery indicates the shared key is encrypted with a key derived from a passphrase instead of a public key
+		IsRecovery bool `json:",omitempty"`
+		// KDF is how the key for a recovery entry is derived from its passphrase
+		KDF *KDFParams `json:",omitempty"`
+	}
+
+	KDFParams struct {
+		// Salt base64 encoded random bytes
+		Salt string
+		// N, R, and P are the scrypt cost parameters
+		N int
+		R int
+		P int
 	}
 )
 
+// currentKeysFileVersion is the version where every key is wrapped with RSA-OAEP or X25519
+const currentKeysFileVersion = 1
+
+// newEncryptedKey gives publicKey access to symKey
+func newEncryptedKey(username, publicKey string, symKey []byte, isHeadless bool, role string) (EncryptedKey, error) {
+	fingerprint, err := keyFingerprint(publicKey)
+	if err != nil {
+		return EncryptedKey{}, err
+	}
+
+	encSymKey, algorithm, err := encryptWithPublicKey(symKey, publicKey)
+	if err != nil {
+		return EncryptedKey{}, fmt.Errorf("error in encryptWithPublicKey: %w", err)
+	}
+
+	return EncryptedKey{
+		Username:           username,
+		PublicKey:          publicKey,
+		Fingerprint:        fingerprint,
+		EncryptedSharedKey: encSymKey,
+		Algorithm:          algorithm,
+		IsHeadless:         isHeadless,
+		Role:               role,
+	}, nil
+}
+
+func keysFilePath(env string) string {
+	return path.Join(getEpicEnvPath(), env, "keys.json")
+}
+
 func readKeysFile(env string) (*KeysFile, error) {
-	epicEnvPath := getEpicEnvPath()
-	fileBytes, err := os.ReadFile(path.Join(epicEnvPath, env, "keys.json"))
+	fileBytes, err := os.ReadFile(keysFilePath(env))
 	if err != nil {
 		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
 	}
@@ -41,7 +137,14 @@ func readKeysFile(env string) (*KeysFile, error) {
 	return &keysFile, nil
 }
 
+// writeKeysFile writes and signs the keys of the root environment env. Secrets files that were signed by a key that
+// is no longer in it are signed again, see resignOrphanedSecrets.
 func writeKeysFile(env string, keysFile KeysFile) error {
+	previous, err := readKeysFile(env)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
 	epicEnvPath := getEpicEnvPath()
 	fileBytes, err := json.MarshalIndent(keysFile, "", "  ")
 	if err != nil {
@@ -53,10 +156,22 @@ func writeKeysFile(env string, keysFile KeysFile) error {
 		return fmt.Errorf("error in os.MkdirAll: %w", err)
 	}
 
-	err = os.WriteFile(path.Join(epicEnvPath, env, "keys.json"), fileBytes, 0777)
+	err = os.WriteFile(keysFilePath(env), fileBytes, 0777)
 	if err != nil {
 		return fmt.Errorf("error in os.WriteFile: %w", err)
 	}
 
+	err = signFile(keysFilePath(env), keysFile.EncryptedKeys)
+	if err != nil {
+		return fmt.Errorf("error signing keys file: %w", err)
+	}
+
+	if previous != nil {
+		err = resignOrphanedSecrets(env, previous, &keysFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -83,3 +83,24 @@ func getOverlayChain(env string) ([]string, error) {
 
 	return append(baseChain, env), nil
 }
+
+// getEnvironmentsForRoot returns the root environment and every overlay that resolves to it
+func getEnvironmentsForRoot(rootEnv string) ([]string, error) {
+	environments, err := listEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var rooted []string
+	for _, env := range environments {
+		envRoot, err := resolveRootEnv(env)
+		if err != nil {
+			return nil, err
+		}
+		if envRoot == rootEnv {
+			rooted = append(rooted, env)
+		}
+	}
+
+	return rooted, nil
+}
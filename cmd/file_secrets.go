@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"slices"
+	"strings"
 
 	"github.com/samber/lo"
 )
@@ -13,6 +16,8 @@ import (
 type (
 	SecretsFile struct {
 		Secrets []EncryptedSecret
+		// Generation is the symmetric key generation that personal secrets were encrypted with
+		Generation int `json:",omitempty"`
 	}
 	EncryptedSecret struct {
 		Name string
@@ -20,6 +25,12 @@ type (
 		Value string `json:",omitempty"`
 		// Personal is whether this should be pulled from the personal_secrets.json file
 		Personal bool
+		// Version 1 values are bound to their environment, name, and personal flag, 0 is legacy
+		Version int `json:",omitempty"`
+		// Group whose key the value is encrypted with, empty for the environment's key
+		Group string `json:",omitempty"`
+		// NeedsRotation is set when someone who could read the value was uninvited, until it is set again
+		NeedsRotation bool `json:",omitempty"`
 	}
 	DecryptedSecret struct {
 		Name string
@@ -30,9 +41,12 @@ type (
 	}
 )
 
+func secretsFilePath(env string, personal bool) string {
+	return path.Join(getEpicEnvPath(), env, lo.Ternary(personal, "personal_secrets.json", "secrets.json"))
+}
+
 func readSecretsFile(env string, personal bool) (*SecretsFile, error) {
-	epicEnvPath := getEpicEnvPath()
-	fileBytes, err := os.ReadFile(path.Join(epicEnvPath, env, lo.Ternary(personal, "personal_secrets.json", "secrets.json")))
+	fileBytes, err := os.ReadFile(secretsFilePath(env, personal))
 	if personal && errors.Is(err, os.ErrNotExist) {
 		// Create a blank one and return
 		secretsFile := SecretsFile{}
@@ -52,21 +66,64 @@ func readSecretsFile(env string, personal bool) (*SecretsFile, error) {
 	return &secretsFile, nil
 }
 
+// sortSecrets sorts secrets by name, so files and diffs only change where values do
+func sortSecrets(secrets []EncryptedSecret) []EncryptedSecret {
+	sorted := slices.Clone(secrets)
+	slices.SortStableFunc(sorted, func(a, b EncryptedSecret) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return sorted
+}
+
+// writeSecretsFile writes and signs secretsFile, unless it is already on disk and signed
 func writeSecretsFile(env string, secretsFile SecretsFile, personal bool) error {
 	epicEnvPath := getEpicEnvPath()
+	secretsFile.Secrets = sortSecrets(secretsFile.Secrets)
 	fileBytes, err := json.MarshalIndent(secretsFile, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error in json.MarshalIndent: %w", err)
 	}
 
-	err = os.MkdirAll(path.Join(epicEnvPath, env), 0777)
+	// Writing the same contents again would only change the signature
+	existing, err := os.ReadFile(secretsFilePath(env, personal))
+	unchanged := err == nil && bytes.Equal(existing, fileBytes)
+
+	if !unchanged {
+		err = os.MkdirAll(path.Join(epicEnvPath, env), 0777)
+		if err != nil {
+			return fmt.Errorf("error in os.MkdirAll: %w", err)
+		}
+
+		err = os.WriteFile(secretsFilePath(env, personal), fileBytes, 0777)
+		if err != nil {
+			return fmt.Errorf("error in os.WriteFile: %w", err)
+		}
+	}
+
+	if personal {
+		// Personal secrets never leave this machine, so there is nobody to prove the write to
+		return nil
+	}
+
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		return fmt.Errorf("error resolving root environment: %w", err)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
 	if err != nil {
-		return fmt.Errorf("error in os.MkdirAll: %w", err)
+		return fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	if unchanged {
+		if _, err := verifyFileSignature(secretsFilePath(env, personal), keysFile.EncryptedKeys); err == nil {
+			return nil
+		}
 	}
 
-	err = os.WriteFile(path.Join(epicEnvPath, env, lo.Ternary(personal, "personal_secrets.json", "secrets.json")), fileBytes, 0777)
+	err = signFile(secretsFilePath(env, personal), keysFile.EncryptedKeys)
 	if err != nil {
-		return fmt.Errorf("error in os.WriteFile: %w", err)
+		return fmt.Errorf("error signing secrets file: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitCommit is a commit from gitLog
+type gitCommit struct {
+	Hash    string
+	Time    time.Time
+	Author  string
+	Parents []string
+}
+
+// runGit runs git in dir and returns its stdout
+func runGit(dir string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	command := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		return nil, fmt.Errorf("error running git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// gitCommitFormat is the format of commits for parseGitCommit
+const gitCommitFormat = "--format=%H%x1f%ct%x1f%P%x1f%an"
+
+// parseGitCommit parses a commit printed with gitCommitFormat
+func parseGitCommit(line string) (gitCommit, error) {
+	fields := strings.Split(strings.TrimSpace(line), "\x1f")
+	if len(fields) != 4 {
+		return gitCommit{}, fmt.Errorf("error parsing commit %q", line)
+	}
+	seconds, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return gitCommit{}, fmt.Errorf("error parsing commit time %q: %w", fields[1], err)
+	}
+	return gitCommit{Hash: fields[0], Time: time.Unix(seconds, 0), Author: fields[3], Parents: strings.Fields(fields[2])}, nil
+}
+
+// gitLog returns the commits that changed paths (relative to dir), oldest first
+func gitLog(dir string, paths ...string) ([]gitCommit, error) {
+	output, err := runGit(dir, append([]string{"log", "--reverse", gitCommitFormat, "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []gitCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line == "" {
+			continue
+		}
+		commit, err := parseGitCommit(line)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+
+	return commits, nil
+}
+
+// gitResolveCommit returns the commit rev refers to
+func gitResolveCommit(dir, rev string) (gitCommit, error) {
+	output, err := runGit(dir, "show", "--no-patch", gitCommitFormat, rev+"^{commit}")
+	if err != nil {
+		return gitCommit{}, err
+	}
+	return parseGitCommit(string(output))
+}
+
+// gitShow returns the contents of path (relative to dir) at commit, os.ErrNotExist if it isn't in the commit
+func gitShow(dir, commit, path string) ([]byte, error) {
+	spec := fmt.Sprintf("%s:./%s", commit, path)
+	if _, err := runGit(dir, "cat-file", "-e", spec); err != nil {
+		return nil, fmt.Errorf("%s is not in %s: %w", path, commit, os.ErrNotExist)
+	}
+	return runGit(dir, "show", spec)
+}
+
+// envForFilePath returns the environment of a file in a .epicenv directory, empty if it isn't in one.
+// Git runs drivers at the top of the repository, which may not be where the .epicenv directory is, so it is
+// used from now on.
+func envForFilePath(filePath string) string {
+	envPath := filepath.Dir(filePath)
+	if filePath == "" || filepath.Base(filepath.Dir(envPath)) != ".epicenv" {
+		return ""
+	}
+
+	if dir, err := filepath.Abs(filepath.Dir(filepath.Dir(envPath))); err == nil {
+		epicEnvDir = dir
+	}
+
+	return filepath.Base(envPath)
+}
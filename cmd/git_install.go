@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// gitAttributes are the lines epicenv needs in .epicenv/.gitattributes, patterns without a slash match in every environment
+var gitAttributes = []string{
+	"keys.json merge=epicenv",
+	"secrets.json merge=epicenv",
+	"secrets.json diff=epicenv",
+	"*.json.sig merge=epicenv",
+}
+
+// gitCmd groups the commands that set up git
+var gitCmd = &cobra.Command{
+	Use:   "git",
+	Short: "Set up git to work with epicenv",
+}
+
+var gitInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Set up git to merge and diff keys and secrets files with epicenv",
+	Long: `Set up git to merge keys.json and secrets.json with 'epicenv merge-driver', so changes to different variables
+on two branches don't conflict, and to diff secrets.json with 'epicenv git-textconv', so diffs show which variables
+changed. --diff-mode is how git diff shows values: full, masked or hash, see 'epicenv git-textconv --help'.
+
+The attributes are written to .epicenv/.gitattributes, which should be committed. The drivers are set in the
+git config of the repository, which is not committed, so everyone needs to run this once in their clone.
+
+Examples:
+  epicenv git install
+  epicenv git install --diff-mode hash`,
+	Run:  runGitInstall,
+	Args: cobra.NoArgs,
+}
+
+var gitInstallHooksCmd = &cobra.Command{
+	Use:   "install-hooks",
+	Short: "Add a pre-commit hook that refuses commits leaking personal or decrypted values",
+	Long: `Add a pre-commit hook that runs 'epicenv precommit', which refuses commits that stage personal_secrets.json,
+the temp-* activation scripts, or files containing the value of a variable you can decrypt.
+
+Hooks are not committed, so everyone needs to run this once in their clone. An existing pre-commit hook is
+left alone, add 'epicenv precommit' to it yourself.
+
+Examples:
+  epicenv git install-hooks`,
+	Run:  runGitInstallHooks,
+	Args: cobra.NoArgs,
+}
+
+var gitInstallDiffModeFlag string
+
+func init() {
+	rootCmd.AddCommand(gitCmd)
+	gitCmd.AddCommand(gitInstallCmd)
+	gitCmd.AddCommand(gitInstallHooksCmd)
+
+	gitInstallCmd.Flags().StringVar(&gitInstallDiffModeFlag, "diff-mode", diffModeMasked, "How git diff shows values: full, masked or hash")
+}
+
+func runGitInstall(cmd *cobra.Command, args []string) {
+	if !slices.Contains(diffModes, gitInstallDiffModeFlag) {
+		logger.Fatal().Msgf("Invalid diff mode '%s', must be one of %s", gitInstallDiffModeFlag, strings.Join(diffModes, ", "))
+	}
+
+	epicEnvPath := getEpicEnvPath()
+	if _, err := os.Stat(epicEnvPath); err != nil {
+		logger.Fatal().Err(err).Msg("Epicenv directory not found, make sure to run init command first")
+	}
+
+	for _, setting := range [][2]string{
+		{"merge.epicenv.name", "epicenv keys and secrets"},
+		{"merge.epicenv.driver", "epicenv merge-driver %O %A %B %P"},
+		// Don't set cachetextconv, it would store decrypted values in git
+		{"diff.epicenv.textconv", "epicenv git-textconv --mode " + gitInstallDiffModeFlag},
+	} {
+		_, err := runGit(epicEnvPath, "config", setting[0], setting[1])
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error configuring git, is the .epicenv directory in a git repository?")
+		}
+	}
+
+	added, err := ensureGitAttributes(path.Join(epicEnvPath, ".gitattributes"), gitAttributes)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing .gitattributes")
+	}
+
+	logger.Info().Msgf("Configured the merge and diff drivers, and added %d lines to .epicenv/.gitattributes, commit it so git uses it for everyone", added)
+}
+
+func runGitInstallHooks(cmd *cobra.Command, args []string) {
+	epicEnvPath := getEpicEnvPath()
+	if _, err := os.Stat(epicEnvPath); err != nil {
+		logger.Fatal().Err(err).Msg("Epicenv directory not found, make sure to run init command first")
+	}
+
+	topLevel, err := runGit(epicEnvPath, "rev-parse", "--show-toplevel")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding the repository, is the .epicenv directory in a git repository?")
+	}
+	// Respects core.hooksPath, relative to the .epicenv directory
+	hookPath, err := runGit(epicEnvPath, "rev-parse", "--git-path", "hooks/pre-commit")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding the git hooks directory")
+	}
+
+	absEpicEnvPath, err := filepath.Abs(epicEnvPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error getting absolute path of .epicenv directory")
+	}
+	// Hooks run at the top of the repository, which may not be where the .epicenv directory is
+	projectDir, err := filepath.Rel(strings.TrimSpace(string(topLevel)), filepath.Dir(absEpicEnvPath))
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding the .epicenv directory in the repository")
+	}
+
+	hookFile := strings.TrimSpace(string(hookPath))
+	if !filepath.IsAbs(hookFile) {
+		hookFile = filepath.Join(epicEnvPath, hookFile)
+	}
+
+	existing, err := os.ReadFile(hookFile)
+	if err == nil {
+		if strings.Contains(string(existing), "epicenv precommit") {
+			logger.Info().Msgf("%s already runs epicenv precommit", hookFile)
+			return
+		}
+		logger.Fatal().Msgf("%s already exists, add 'epicenv precommit' to it to check commits", hookFile)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		logger.Fatal().Err(err).Msgf("error reading %s", hookFile)
+	}
+
+	err = os.MkdirAll(filepath.Dir(hookFile), 0777)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error creating the git hooks directory")
+	}
+	err = os.WriteFile(hookFile, []byte(preCommitHook(projectDir)), 0777)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error writing %s", hookFile)
+	}
+
+	logger.Info().Msgf("Added a pre-commit hook at %s", hookFile)
+}
+
+// preCommitHook is the pre-commit hook script, projectDir is the directory with .epicenv relative to the top of the repository
+func preCommitHook(projectDir string) string {
+	hook := "#!/bin/sh\n# Added by 'epicenv git install-hooks', refuses commits that leak personal or decrypted values\n"
+	if projectDir != "." {
+		quoted := "'" + strings.ReplaceAll(filepath.ToSlash(projectDir), "'", `'\''`) + "'"
+		hook += fmt.Sprintf("cd %s || exit 1\n", quoted)
+	}
+	return hook + "exec epicenv precommit\n"
+}
+
+// ensureGitAttributes adds the lines that are missing from the .gitattributes file at filePath.
+// Returns how many were added.
+func ensureGitAttributes(filePath string, lines []string) (int, error) {
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	fileString := string(fileBytes)
+	existing := strings.Split(fileString, "\n")
+	added := 0
+	for _, line := range lines {
+		if slices.Contains(existing, line) {
+			continue
+		}
+		if fileString != "" && !strings.HasSuffix(fileString, "\n") {
+			fileString += "\n"
+		}
+		fileString += line + "\n"
+		added++
+	}
+
+	if added == 0 {
+		return 0, nil
+	}
+
+	err = os.WriteFile(filePath, []byte(fileString), 0666)
+	if err != nil {
+		return 0, fmt.Errorf("error in os.WriteFile: %w", err)
+	}
+
+	return added, nil
+}
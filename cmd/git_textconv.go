@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// diffModeFull shows decrypted values
+	diffModeFull = "full"
+	// diffModeMasked shows only the start and end of long values
+	diffModeMasked = "masked"
+	// diffModeHash shows a hash of values keyed with the environment's key, so every change shows without the value
+	diffModeHash = "hash"
+)
+
+var diffModes = []string{diffModeFull, diffModeMasked, diffModeHash}
+
+// diffHashContext separates the key for hashing values from the symmetric key it is derived from
+var diffHashContext = []byte("epicenv git-textconv v1")
+
+var gitTextconvCmd = &cobra.Command{
+	Use:   "git-textconv FILE",
+	Short: "Print a secrets file as sorted NAME=value lines for git diff",
+	Long: `Print a secrets.json file as NAME=value lines sorted by name, so git diff shows which variables were added,
+removed or changed instead of every value that was encrypted again. Run by git as a textconv diff driver after
+'epicenv git install'.
+
+--mode is how values are shown:
+  full    the decrypted value
+  masked  only the first and last 2 characters of values of at least 12 characters, changes to shorter values don't show
+  hash    a hash keyed with the environment's key, so every change shows without the value
+
+Set EPICENV_DIFF_MODE to override the mode set up by 'epicenv git install', e.g. EPICENV_DIFF_MODE=full git diff
+
+Values from older commits are decrypted with the previous keys if the key was rotated since. Personal values and
+the values of groups you are not in can't be decrypted.
+
+Examples:
+  epicenv git-textconv .epicenv/local/secrets.json
+  epicenv git-textconv --mode full .epicenv/prod/secrets.json`,
+	Run:  runGitTextconv,
+	Args: cobra.ExactArgs(1),
+}
+
+var diffModeFlag string
+
+func init() {
+	rootCmd.AddCommand(gitTextconvCmd)
+	gitTextconvCmd.Flags().StringVar(&diffModeFlag, "mode", diffModeMasked, "How to show values: full, masked or hash")
+}
+
+func runGitTextconv(cmd *cobra.Command, args []string) {
+	mode := diffModeFlag
+	if envMode := os.Getenv("EPICENV_DIFF_MODE"); envMode != "" {
+		mode = envMode
+	}
+	requireDiffMode(mode)
+
+	fileBytes, err := os.ReadFile(args[0])
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error reading %s", args[0])
+	}
+
+	secretsFile, err := parseGitFile[SecretsFile](fileBytes)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error parsing %s", args[0])
+	}
+
+	// Git gives older revisions as temporary files, so we may have to find which environment they are from
+	var keys *envKeyring
+	if env := envForFilePath(args[0]); env != "" {
+		keys, err = loadEnvKeyring(env)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Can't decrypt the values of %s", env)
+		}
+	} else {
+		keys = findEnvKeyring(secretsFile)
+	}
+
+	fmt.Print(textconvSecretsFile(secretsFile, func(item EncryptedSecret) (string, bool) {
+		value, _, ok := keys.decrypt(item)
+		if !ok {
+			return "", false
+		}
+		return keys.display(mode, value), true
+	}))
+}
+
+// requireDiffMode exits if mode is not one of diffModes
+func requireDiffMode(mode string) {
+	if !slices.Contains(diffModes, mode) {
+		logger.Fatal().Msgf("Invalid mode '%s', must be one of %s", mode, strings.Join(diffModes, ", "))
+	}
+}
+
+// display shows a value decrypted with k in mode
+func (k *envKeyring) display(mode, value string) string {
+	switch mode {
+	case diffModeFull:
+		return value
+	case diffModeHash:
+		mac := hmac.New(sha256.New, k.symKey)
+		mac.Write(diffHashContext)
+		return hashValue(mac.Sum(nil), value)
+	default:
+		return maskValue(value)
+	}
+}
+
+// findEnvKeyring finds the environment whose key decrypts the values of secretsFile, nil if none do
+func findEnvKeyring(secretsFile *SecretsFile) *envKeyring {
+	item, found := lo.Find(secretsFile.Secrets, func(item EncryptedSecret) bool {
+		return !item.Personal && item.Group == ""
+	})
+	if !found {
+		return nil
+	}
+
+	environments, err := listEnvironments()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Can't list environments")
+		return nil
+	}
+
+	for _, env := range environments {
+		keys, err := loadEnvKeyring(env)
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Can't decrypt the values of %s", env)
+			continue
+		}
+		// Values are bound to their environment, so only the right one decrypts them
+		if _, _, ok := keys.decrypt(item); ok {
+			return keys
+		}
+	}
+
+	logger.Warn().Msg("None of your environments can decrypt the values")
+	return nil
+}
+
+// textconvSecretsFile renders secretsFile as NAME=value lines sorted by name, show gives the value to show or false
+// if it can't be decrypted
+func textconvSecretsFile(secretsFile *SecretsFile, show func(item EncryptedSecret) (string, bool)) string {
+	var lines strings.Builder
+	for _, item := range sortSecrets(secretsFile.Secrets) {
+		var value string
+		shown, ok := show(item)
+		switch {
+		case item.Personal:
+			value = "(personal)"
+		case !ok:
+			// The encrypted value changes whenever it is set, so changes still show
+			hash := sha256.Sum256([]byte(item.Value))
+			value = fmt.Sprintf("(encrypted %x)", hash[:4])
+		case strings.ContainsAny(shown, "\n\r\"") || strings.TrimSpace(shown) != shown:
+			value = strconv.Quote(shown)
+		default:
+			value = shown
+		}
+
+		var notes []string
+		if item.Group != "" {
+			notes = append(notes, "group "+item.Group)
+		}
+		if item.NeedsRotation {
+			notes = append(notes, "needs rotation")
+		}
+
+		lines.WriteString(item.Name + "=" + value)
+		if len(notes) > 0 {
+			lines.WriteString(" # " + strings.Join(notes, ", "))
+		}
+		lines.WriteString("\n")
+	}
+
+	return lines.String()
+}
+
+// maskValue shows only the first and last 2 characters of values of at least 12 characters
+func maskValue(value string) string {
+	runes := []rune(value)
+	if len(runes) < 12 {
+		return "****"
+	}
+	return string(runes[:2]) + "****" + string(runes[len(runes)-2:])
+}
+
+// hashValue is a short HMAC-SHA256 of value, which can't be checked against guesses without the key
+func hashValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
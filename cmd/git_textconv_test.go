@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestTextconvSecretsFile(t *testing.T) {
+	secretsFile := &SecretsFile{Secrets: []EncryptedSecret{
+		{Name: "ZED", Value: "zed"},
+		{Name: "API", Value: "api", NeedsRotation: true},
+		{Name: "MINE", Personal: true},
+		{Name: "OPS", Value: "ops", Group: "ops"},
+		{Name: "MULTILINE", Value: "a\nb"},
+		{Name: "UNKNOWN", Value: "ciphertext"},
+	}}
+	show := func(item EncryptedSecret) (string, bool) {
+		return item.Value, item.Name != "UNKNOWN" && !item.Personal
+	}
+
+	want := `API=api # needs rotation
+MINE=(personal)
+MULTILINE="a\nb"
+OPS=ops # group ops
+UNKNOWN=(encrypted 305531dc)
+ZED=zed
+`
+	if got := textconvSecretsFile(secretsFile, show); got != want {
+		t.Errorf("textconvSecretsFile() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "****"},
+		{"short", "****"},
+		{"postgres://db", "po****db"},
+		{"ünïcödé-välüé", "ün****üé"},
+	}
+	for _, tt := range tests {
+		if got := maskValue(tt.value); got != tt.want {
+			t.Errorf("maskValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHashValue(t *testing.T) {
+	key := []byte("key")
+	if hashValue(key, "a") != hashValue(key, "a") {
+		t.Errorf("hashValue() is not deterministic")
+	}
+	if hashValue(key, "a") == hashValue(key, "b") || hashValue(key, "a") == hashValue([]byte("other"), "a") {
+		t.Errorf("hashValue() collided")
+	}
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// githubPageSize is the most the GitHub API returns per page
+const githubPageSize = 100
+
+// githubClient is a minimal client for the GitHub REST API
+type githubClient struct {
+	// baseURL is https://api.github.com, or https://HOST/api/v3 for GitHub Enterprise
+	baseURL string
+	token   string
+}
+
+// newGithubClient configures a client from EPICENV_GITHUB_API_URL, and EPICENV_GITHUB_TOKEN or GITHUB_TOKEN
+func newGithubClient() *githubClient {
+	return &githubClient{
+		baseURL: strings.TrimSuffix(lo.CoalesceOrEmpty(os.Getenv("EPICENV_GITHUB_API_URL"), "https://api.github.com"), "/"),
+		token:   lo.CoalesceOrEmpty(os.Getenv("EPICENV_GITHUB_TOKEN"), os.Getenv("GITHUB_TOKEN")),
+	}
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+// listTeamMembers returns the logins of the members of a team, which needs a token that can read the org
+func (c *githubClient) listTeamMembers(org, team string) ([]string, error) {
+	return c.listLogins(fmt.Sprintf("/orgs/%s/teams/%s/members", url.PathEscape(org), url.PathEscape(team)))
+}
+
+// listOrgMembers returns the logins of the members of an org, only public members without a token
+func (c *githubClient) listOrgMembers(org string) ([]string, error) {
+	return c.listLogins(fmt.Sprintf("/orgs/%s/members", url.PathEscape(org)))
+}
+
+// listLogins gets every page of users from path
+func (c *githubClient) listLogins(path string) ([]string, error) {
+	var logins []string
+	for page := 1; ; page++ {
+		var users []githubUser
+		err := c.get(fmt.Sprintf("%s?per_page=%d&page=%d", path, githubPageSize, page), &users)
+		if err != nil {
+			return nil, err
+		}
+
+		logins = append(logins, lo.Map(users, func(item githubUser, index int) string {
+			return item.Login
+		})...)
+
+		if len(users) < githubPageSize {
+			return logins, nil
+		}
+	}
+}
+
+func (c *githubClient) get(path string, out any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("error in http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error in http.DefaultClient.Do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return ErrNotFound
+	}
+
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error in io.ReadAll(res.Body): %w", err)
+	}
+
+	if res.StatusCode >= 299 {
+		return fmt.Errorf("high status code: %d %s", res.StatusCode, string(bodyBytes))
+	}
+
+	err = json.Unmarshal(bodyBytes, out)
+	if err != nil {
+		return fmt.Errorf("error in json.Unmarshal: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestGithubClientListMembers(t *testing.T) {
+	// 150 org members, so they take two pages
+	var orgMembers []string
+	for i := 0; i < 150; i++ {
+		orgMembers = append(orgMembers, fmt.Sprintf("user%d", i))
+	}
+
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+
+		var members []string
+		switch r.URL.Path {
+		case "/api/v3/orgs/acme/members":
+			members = orgMembers
+		case "/api/v3/orgs/acme/teams/backend/members":
+			members = []string{"alice", "bob"}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		start := min((page-1)*perPage, len(members))
+		end := min(start+perPage, len(members))
+		w.Write([]byte("["))
+		for i, login := range members[start:end] {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			fmt.Fprintf(w, `{"login":%q}`, login)
+		}
+		w.Write([]byte("]"))
+	}))
+	defer server.Close()
+
+	t.Setenv("EPICENV_GITHUB_API_URL", server.URL+"/api/v3/")
+	t.Setenv("EPICENV_GITHUB_TOKEN", "")
+	t.Setenv("GITHUB_TOKEN", "secret")
+	client := newGithubClient()
+
+	members, err := client.listTeamMembers("acme", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"alice", "bob"}) {
+		t.Fatalf("unexpected team members %v", members)
+	}
+	if authHeader != "Bearer secret" {
+		t.Fatalf("unexpected Authorization header %q", authHeader)
+	}
+
+	members, err = client.listOrgMembers("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, orgMembers) {
+		t.Fatalf("expected %d org members, got %d", len(orgMembers), len(members))
+	}
+
+	if _, err := client.listTeamMembers("acme", "frontend"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -4,46 +4,75 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"slices"
 	"strings"
 )
 
+// gitIgnorePatterns are the files in .epicenv that must never be committed
+var gitIgnorePatterns = []string{
+	".epicenv/*/personal_secrets.json",
+	".epicenv/*/temp-*",
+}
+
+// staleGitIgnorePatterns were added by older versions, and don't match the files they were meant for
+var staleGitIgnorePatterns = []string{
+	".epicenv/*/personal_keys.json",
+	".epicenv/temp*",
+}
+
+// prepareGitIgnore adds gitIgnorePatterns to the .gitignore next to the .epicenv directory, replacing the
+// stale patterns of older versions
 func prepareGitIgnore() error {
-	if _, err := os.Stat(".gitignore"); errors.Is(err, os.ErrNotExist) {
-		// create the file
+	ignorePath := path.Join(path.Dir(getEpicEnvPath()), ".gitignore")
+	mode := os.FileMode(0666)
+
+	fileContent, err := os.ReadFile(ignorePath)
+	if errors.Is(err, os.ErrNotExist) {
 		logger.Debug().Msg("creating .gitignore")
-		f, err := os.Create(".gitignore")
-		if err != nil {
-			return fmt.Errorf("error in os.Create for .gitignore: %w", err)
-		}
-		err = f.Close()
-		if err != nil {
-			return fmt.Errorf("error in f.Close(): %w", err)
-		}
 	} else if err != nil {
-		logger.Fatal().Err(err).Msg("error checking if file exists")
-	}
-
-	// Check if the rows exist already
-	fileContent, err := os.ReadFile(".gitignore")
-	if err != nil {
 		return fmt.Errorf("error in os.ReadFile: %w", err)
+	} else {
+		ignoreStat, err := os.Stat(ignorePath)
+		if err != nil {
+			return fmt.Errorf("error getting stats on .gitignore: %w", err)
+		}
+		mode = ignoreStat.Mode()
 	}
 
 	fileString := string(fileContent)
-
-	ignoreStat, err := os.Stat(".gitignore")
-	if err != nil {
-		logger.Fatal().Err(err).Msg("error getting stats on .gitignore")
+	lines := strings.Split(fileString, "\n")
+	var repaired []string
+	for _, line := range lines {
+		if !slices.Contains(staleGitIgnorePatterns, strings.TrimSpace(line)) {
+			repaired = append(repaired, line)
+			continue
+		}
+		// Older versions added a blank line before each pattern
+		if len(repaired) > 0 && strings.TrimSpace(repaired[len(repaired)-1]) == "" {
+			repaired = repaired[:len(repaired)-1]
+		}
+	}
+	if len(repaired) != len(lines) {
+		logger.Info().Msg("Replacing .gitignore patterns that didn't match the personal secrets and activation files")
+		fileString = strings.Join(repaired, "\n")
 	}
 
-	if !strings.Contains(fileString, ".epicenv/*/personal_keys.json") {
-		fileString += "\n.epicenv/*/personal_keys.json\n"
+	for _, pattern := range gitIgnorePatterns {
+		if slices.Contains(repaired, pattern) {
+			continue
+		}
+		if fileString != "" && !strings.HasSuffix(fileString, "\n") {
+			fileString += "\n"
+		}
+		fileString += pattern + "\n"
 	}
-	if !strings.Contains(fileString, ".epicenv/temp*") {
-		fileString += "\n.epicenv/temp*\n"
+
+	if fileString == string(fileContent) {
+		return nil
 	}
 
-	err = os.WriteFile(".gitignore", []byte(fileString), ignoreStat.Mode())
+	err = os.WriteFile(ignorePath, []byte(fileString), mode)
 	if err != nil {
 		return fmt.Errorf("error in WriteFile for .gitignore: %w", err)
 	}
@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ErrNoLocalKey      = errors.New("did not find any local private keys matching a known public key")
+	ErrNotGroupMember  = errors.New("not a member of the group")
+	ErrGroupNotFound   = errors.New("group not found")
+	ErrGroupNameExists = errors.New("group already exists")
+)
+
+// groupCmd represents the group command
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Manage groups for values only some invitees can decrypt",
+	Long: `Manage groups for values that only some of the invitees can decrypt.
+
+Each group has its own key, which is only encrypted for its members. Set a value in a group with
+'epicenv set --group NAME KEY VALUE'. Invitees who are not in the group skip its values when loading
+the environment.
+
+Only admins can manage groups, and only members can add others to a group.
+
+Examples:
+  epicenv group create ops alice bob   # Create a group with you, alice and bob in it
+  epicenv group add ops carol          # Add carol to the group
+  epicenv group remove ops bob         # Remove bob from the group
+  epicenv group list                   # List groups and their members`,
+}
+
+var groupCreateCmd = &cobra.Command{
+	Use:   "create NAME [USER...]",
+	Short: "Create a group with you and the given users in it",
+	Run:   runGroupCreate,
+	Args:  cobra.MinimumNArgs(1),
+}
+
+var groupAddCmd = &cobra.Command{
+	Use:   "add NAME USER...",
+	Short: "Add invited users to a group",
+	Run:   runGroupAdd,
+	Args:  cobra.MinimumNArgs(2),
+}
+
+var groupRemoveCmd = &cobra.Command{
+	Use:   "remove NAME USER...",
+	Short: "Remove users from a group",
+	Long: `Remove users from a group.
+
+They could have kept the group key, so change the values in the group if they should lose access to them.`,
+	Run:  runGroupRemove,
+	Args: cobra.MinimumNArgs(2),
+}
+
+var groupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List groups and their members",
+	Run:   runGroupList,
+	Args:  cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(groupCmd)
+	groupCmd.AddCommand(groupCreateCmd)
+	groupCmd.AddCommand(groupAddCmd)
+	groupCmd.AddCommand(groupRemoveCmd)
+	groupCmd.AddCommand(groupListCmd)
+}
+
+// loadKeysForGroupChange loads the keys file of the root of env, making sure we can change it
+func loadKeysForGroupChange(env string) (string, *KeysFile) {
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Groups belong to root environment '%s' (overlays share them)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	// Make sure that we are invited to the env
+	_, err = loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	return rootEnv, keysFile
+}
+
+// normalizeInvitedUsers normalizes the users in args, and makes sure they are invited
+func normalizeInvitedUsers(keysFile *KeysFile, args []string) []string {
+	return lo.Map(args, func(arg string, index int) string {
+		username := arg
+		if normalized, err := normalizeUserSpec(arg); err == nil {
+			username = normalized
+		}
+		if userRole(keysFile, username) == "" {
+			logger.Fatal().Msgf("'%s' is not invited to this environment", username)
+		}
+		return username
+	})
+}
+
+func runGroupCreate(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+	name := args[0]
+	rootEnv, keysFile := loadKeysForGroupChange(env)
+
+	if _, err := findGroup(keysFile, name); err == nil {
+		logger.Fatal().Err(ErrGroupNameExists).Msgf("There is already a group '%s'", name)
+	}
+
+	// We are always a member, otherwise nobody may be able to add anyone
+	usernames := lo.Uniq(append(localUsernames(keysFile), normalizeInvitedUsers(keysFile, args[1:])...))
+
+	group := Group{Name: name}
+	groupKey := generateAESKey()
+	for _, username := range usernames {
+		_, err := addGroupMember(keysFile, &group, groupKey, username)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error adding %s to the group", username)
+		}
+	}
+	keysFile.Groups = append(keysFile.Groups, group)
+
+	err := writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	logger.Info().Msgf("Created group '%s' with %s", name, strings.Join(usernames, ", "))
+}
+
+func runGroupAdd(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+	name := args[0]
+	rootEnv, keysFile := loadKeysForGroupChange(env)
+
+	group, err := findGroup(keysFile, name)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error finding group '%s'", name)
+	}
+
+	groupKey, err := unwrapGroupKey(group)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error decrypting the key of group '%s', only members can add others", name)
+	}
+
+	for _, username := range normalizeInvitedUsers(keysFile, args[1:]) {
+		added, err := addGroupMember(keysFile, group, groupKey, username)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error adding %s to the group", username)
+		}
+		logger.Info().Msgf("Added %d keys of %s to '%s'", added, username, name)
+	}
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+}
+
+func runGroupRemove(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+	name := args[0]
+	rootEnv, keysFile := loadKeysForGroupChange(env)
+
+	group, err := findGroup(keysFile, name)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error finding group '%s'", name)
+	}
+
+	usernames := lo.Map(args[1:], func(arg string, index int) string {
+		if normalized, err := normalizeUserSpec(arg); err == nil {
+			return normalized
+		}
+		return arg
+	})
+	for _, username := range usernames {
+		if !lo.Contains(groupMembers(group), username) {
+			logger.Fatal().Msgf("'%s' is not a member of '%s'", username, name)
+		}
+	}
+	if len(lo.Without(groupMembers(group), usernames...)) == 0 {
+		logger.Fatal().Msgf("Refusing to remove every member of '%s', nobody could decrypt its values", name)
+	}
+
+	group.EncryptedKeys = lo.Filter(group.EncryptedKeys, func(item EncryptedKey, index int) bool {
+		return !lo.Contains(usernames, item.Username)
+	})
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	logger.Info().Msgf("Removed %s from '%s' **CHANGE THE VALUES IN THE GROUP IF THEY SHOULD LOSE ACCESS!**", strings.Join(usernames, ", "), name)
+}
+
+func runGroupList(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	if len(keysFile.Groups) == 0 {
+		logger.Info().Msgf("No groups in environment '%s'", rootEnv)
+		return
+	}
+
+	ourUsernames := localUsernames(keysFile)
+	for _, group := range keysFile.Groups {
+		members := lo.Map(groupMembers(&group), func(username string, index int) string {
+			if lo.Contains(ourUsernames, username) {
+				return username + " (you)"
+			}
+			return username
+		})
+		logger.Info().Msgf("- %s: %s", group.Name, strings.Join(members, ", "))
+	}
+}
+
+// findGroup finds the group called name in keysFile, so it can be changed in place
+func findGroup(keysFile *KeysFile, name string) (*Group, error) {
+	for i := range keysFile.Groups {
+		if keysFile.Groups[i].Name == name {
+			return &keysFile.Groups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, name)
+}
+
+// groupMembers returns the usernames of the members of group
+func groupMembers(group *Group) []string {
+	return lo.Uniq(lo.Map(group.EncryptedKeys, func(item EncryptedKey, index int) string {
+		return item.Username
+	}))
+}
+
+// addGroupMember encrypts groupKey for every invited key of username that is not in group yet.
+// Returns the number of keys that were added.
+func addGroupMember(keysFile *KeysFile, group *Group, groupKey []byte, username string) (int, error) {
+	added := 0
+	for _, item := range keysFile.EncryptedKeys {
+		if item.Username != username || lo.ContainsBy(group.EncryptedKeys, func(groupKey EncryptedKey) bool {
+			return groupKey.PublicKey == item.PublicKey
+		}) {
+			continue
+		}
+
+		encKey, err := newEncryptedKey(username, item.PublicKey, groupKey, item.IsHeadless, "")
+		if err != nil {
+			return 0, err
+		}
+		group.EncryptedKeys = append(group.EncryptedKeys, encKey)
+		added++
+	}
+
+	return added, nil
+}
+
+// unwrapGroupKey decrypts the key of group with our local keys
+func unwrapGroupKey(group *Group) ([]byte, error) {
+	groupKey, err := unwrapWithLocalKeys(group.EncryptedKeys)
+	if errors.Is(err, ErrNoLocalKey) {
+		return nil, fmt.Errorf("%w: %s", ErrNotGroupMember, group.Name)
+	}
+	return groupKey, err
+}
+
+// localUsernames returns the usernames of our local keys that are invited
+func localUsernames(keysFile *KeysFile) []string {
+	keyPairs := findPrivateKeysForPublicKeys(lo.Map(keysFile.EncryptedKeys, func(item EncryptedKey, index int) string {
+		return item.PublicKey
+	}))
+
+	return lo.Uniq(lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+		return item.Username, lo.ContainsBy(keyPairs, func(kp keyPair) bool {
+			return kp.publicKeyContent == item.PublicKey
+		})
+	}))
+}
+
+// groupKeyForEnv decrypts the key of the group called name in the root of env
+func groupKeyForEnv(env, name string) ([]byte, error) {
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving root environment: %w", err)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	group, err := findGroup(keysFile, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapGroupKey(group)
+}
+
+// groupKeyring decrypts group keys when they are first needed, so we don't ask for passphrases we don't need
+type groupKeyring struct {
+	keysFile *KeysFile
+	keys     map[string][]byte
+	errs     map[string]error
+}
+
+func newGroupKeyring(keysFile *KeysFile) *groupKeyring {
+	return &groupKeyring{
+		keysFile: keysFile,
+		keys:     make(map[string][]byte),
+		errs:     make(map[string]error),
+	}
+}
+
+// key returns the key of the group called name, ErrNotGroupMember if we are not a member
+func (g *groupKeyring) key(name string) ([]byte, error) {
+	if key, found := g.keys[name]; found {
+		return key, nil
+	}
+	if err, found := g.errs[name]; found {
+		return nil, err
+	}
+
+	group, err := findGroup(g.keysFile, name)
+	if err != nil {
+		g.errs[name] = err
+		return nil, err
+	}
+
+	key, err := unwrapGroupKey(group)
+	if err != nil {
+		g.errs[name] = err
+		return nil, err
+	}
+
+	g.keys[name] = key
+	return key, nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestGroupKeys(t *testing.T) {
+	alicePublic, alicePrivate, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPublic, bobPrivate, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := &KeysFile{
+		EncryptedKeys: []EncryptedKey{
+			{Username: "alice", PublicKey: alicePublic},
+			{Username: "bob", PublicKey: bobPublic},
+		},
+	}
+
+	group := Group{Name: "ops"}
+	groupKey := generateAESKey()
+	added, err := addGroupMember(keysFile, &group, groupKey, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Fatalf("expected 1 key added, got %d", added)
+	}
+	// Adding again doesn't duplicate keys
+	if added, _ := addGroupMember(keysFile, &group, groupKey, "alice"); added != 0 {
+		t.Fatalf("expected no keys added, got %d", added)
+	}
+	keysFile.Groups = append(keysFile.Groups, group)
+
+	t.Setenv("EPICENV_PRIVATE_KEY", string(alicePrivate))
+	key, err := newGroupKeyring(keysFile).key("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, groupKey) {
+		t.Fatal("group key mismatch")
+	}
+
+	t.Setenv("EPICENV_PRIVATE_KEY", string(bobPrivate))
+	keyring := newGroupKeyring(keysFile)
+	if _, err := keyring.key("ops"); !errors.Is(err, ErrNotGroupMember) {
+		t.Fatalf("expected ErrNotGroupMember, got %v", err)
+	}
+	if _, err := keyring.key("payments"); !errors.Is(err, ErrGroupNotFound) {
+		t.Fatalf("expected ErrGroupNotFound, got %v", err)
+	}
+}
@@ -43,6 +43,7 @@ func runImport(cmd *cobra.Command, args []string) {
 
 	logger.Debug().Interface("loadedEnvVars", lo.Keys(loadedEnvMap)).Msg("loaded env map")
 
+	changed := 0
 	for key, val := range loadedEnvMap {
 		personal := false
 		if strings.HasSuffix(val, "#personal") {
@@ -50,8 +51,10 @@ func runImport(cmd *cobra.Command, args []string) {
 			personal = true
 			val = strings.TrimSpace(strings.Split(val, "#personal")[0])
 		}
-		setEnvVar(env, key, val, personal)
+		if setEnvVar(env, key, val, personal, "") {
+			changed++
+		}
 	}
 
-	logger.Info().Msgf("Imported %d variables from %s", len(loadedEnvMap), envPath)
+	logger.Info().Msgf("Imported %d variables from %s, %d of them changed", len(loadedEnvMap), envPath, changed)
 }
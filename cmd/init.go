@@ -9,11 +9,12 @@ var overlayFlag string
 
 // initCmd represents the init command
 var initCmd = &cobra.Command{
-	Use:   "init [GITHUB_USERNAME]",
+	Use:   "init [USER]",
 	Short: "Initialize EpicEnv",
 	Long: `Initialize EpicEnv with a new environment.
 
-Provide your GitHub username as an argument to fetch your public SSH keys.
+Provide your GitHub username as an argument to fetch your public SSH keys. Prefix it
+to fetch your keys from elsewhere, e.g. gitlab:USERNAME (see 'epicenv invite --help').
 Use the -e flag to specify the environment name (defaults to "local").
 
 For overlay environments, use --overlay to specify the base environment.
@@ -22,6 +23,7 @@ Overlays inherit keys/users from their base and stack secrets on top.
 Examples:
   epicenv init danthegoodman1                  # Creates default "local" environment
   epicenv init danthegoodman1 -e staging       # Creates "staging" environment
+  epicenv init gitlab:danthegoodman1           # Uses your keys from GitLab
   epicenv init -e testing --overlay local      # Creates "testing" as overlay of "local"`,
 	Run:  runInit,
 	Args: cobra.MaximumNArgs(1),
@@ -54,29 +56,32 @@ func runInit(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	// Regular environment - requires GitHub username
+	// Regular environment - requires a username
 	if len(args) == 0 {
 		logger.Fatal().Msg("GitHub username is required for non-overlay environments")
 	}
-	githubUser := args[0]
-	logger.Debug().Msgf("Got github username %s", githubUser)
+	username, err := normalizeUserSpec(args[0])
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid user")
+	}
+	logger.Debug().Msgf("Got username %s", username)
 	logger.Debug().Msgf("Env %s does not exist, creating", env)
 
-	pubKeys, err := getKeysForGithubUsername(githubUser)
+	pubKeys, err := getKeysForUser(username)
 	if err != nil {
-		logger.Fatal().Err(err).Msgf("error getting keys from github for %s", githubUser)
+		logger.Fatal().Err(err).Msgf("error getting keys for %s", username)
 	}
 
-	logger.Debug().Msgf("Got %d keys from github for %s", len(pubKeys), githubUser)
+	logger.Debug().Msgf("Got %d keys for %s", len(pubKeys), username)
 
 	if len(pubKeys) == 0 {
-		logger.Fatal().Msgf("No keys found for GitHub user %s, please add an SSH key to set up EpicEnv!", githubUser)
+		logger.Fatal().Msgf("No keys found for user %s, please add an SSH key to set up EpicEnv!", username)
 	}
 
 	foundKeys := findPrivateKeysForPublicKeys(pubKeys)
 	logger.Debug().Msgf("Found %d private keys in $HOME/.ssh", len(foundKeys))
 	if len(foundKeys) == 0 {
-		logger.Fatal().Msgf("Did not find any of the keys in GitHub for %s in $HOME/.ssh/", githubUser)
+		logger.Fatal().Msgf("Did not find any of the keys for %s in $HOME/.ssh/", username)
 	}
 
 	// append personal secrets to gitignore or create it
@@ -90,18 +95,16 @@ func runInit(cmd *cobra.Command, args []string) {
 
 	// write keys to disk
 	keysFile := KeysFile{
+		Version:        currentKeysFileVersion,
+		SecretsVersion: currentSecretVersion,
 		EncryptedKeys: lo.Map(foundKeys, func(item keyPair, index int) EncryptedKey {
-			// Encrypt the symmetric key with their private key
-			encryptedAESKey, err := encryptWithPublicKey(aesKey, item.publicKeyContent)
+			// Encrypt the symmetric key with their public key
+			encKey, err := newEncryptedKey(username, item.publicKeyContent, aesKey, false, roleAdmin)
 			if err != nil {
-				logger.Fatal().Err(err).Msg("error in encryptWithPublicKey")
+				logger.Fatal().Err(err).Msg("error encrypting with public key")
 			}
 
-			return EncryptedKey{
-				Username:           githubUser,
-				PublicKey:          item.publicKeyContent,
-				EncryptedSharedKey: encryptedAESKey,
-			}
+			return encKey
 		}),
 	}
 	err = writeKeysFile(env, keysFile)
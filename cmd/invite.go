@@ -2,7 +2,7 @@ package cmd
 
 import (
 	"os"
-	"strings"
+	"time"
 
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
@@ -11,25 +11,68 @@ import (
 // inviteCmd represents the invite command
 var inviteCmd = &cobra.Command{
 	Use:   "invite [name]",
-	Short: "Invite a GitHub user or add a headless key to the EpicEnv",
-	Long: `Invite a GitHub user to the EpicEnv, allowing them to decrypt the environment,
-or add a headless key (not associated with a GitHub user).
+	Short: "Invite a user or add a headless key to the EpicEnv",
+	Long: `Invite a user to the EpicEnv, allowing them to decrypt the environment,
+or add a headless key (not associated with a user).
+
+Invitees are writers by default, who can change shared values. Readers can only read values and set their
+own personal values, and admins can also invite and uninvite others. Only admins can invite.
+
+Teams and orgs are listed with the GitHub API, which for teams needs a token that can read the org in
+EPICENV_GITHUB_TOKEN or GITHUB_TOKEN. Use EPICENV_GITHUB_API_URL for GitHub Enterprise, e.g.
+https://github.example.com/api/v3. Members that are already invited are left as they are.
+
+Users are GitHub users by default, prefix them to fetch their keys from elsewhere:
+  github:USER   GitHub, or GitHub Enterprise with EPICENV_GITHUB_URL
+  gitlab:USER   GitLab, or a self-hosted instance with EPICENV_GITLAB_URL
+  gitea:USER    Gitea, at EPICENV_GITEA_URL
+  dir:USER      The authorized_keys style file EPICENV_KEYS_DIR/USER.keys
 
 Examples:
   epicenv invite username               # Invite GitHub user by username
-  epicenv invite keyname --path key.pub # Add a headless key from a file`,
+  epicenv invite gitlab:username        # Invite GitLab user by username
+  epicenv invite username --accept-new  # Give new keys of an invited user access
+  epicenv invite username --role reader # Invite a user who can't change shared values
+  epicenv invite username --role admin  # Change the role of an invited user
+  epicenv invite keyname --path key.pub # Add a headless key from a file
+  epicenv invite username --expires 30d # Invite a contractor for 30 days, see prune-expired
+  epicenv invite username --expires never # Remove the expiry of an invited user
+  epicenv invite --team acme/backend    # Invite every member of a GitHub team
+  epicenv invite --org acme --sync      # Invite every member of a GitHub org, and uninvite who left`,
 	Run:  runInvite,
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MaximumNArgs(1),
 }
 
-var pathFlag string
+var (
+	pathFlag       string
+	inviteRoleFlag string
+	inviteTeamFlag string
+	inviteOrgFlag  string
+	inviteSyncFlag bool
+
+	inviteExpiresFlag string
+)
 
 func init() {
 	rootCmd.AddCommand(inviteCmd)
 	inviteCmd.Flags().StringVar(&pathFlag, "path", "", "Path to public key file (for headless keys)")
+	inviteCmd.Flags().BoolVar(&acceptNewFlag, "accept-new", false, "Give new keys of an already invited user access")
+	inviteCmd.Flags().StringVar(&inviteRoleFlag, "role", roleWriter, "Role of the invitee: admin, writer or reader")
+	inviteCmd.Flags().StringVar(&inviteTeamFlag, "team", "", "Invite every member of a GitHub team, as ORG/TEAM")
+	inviteCmd.Flags().StringVar(&inviteOrgFlag, "org", "", "Invite every member of a GitHub org")
+	inviteCmd.Flags().StringVar(&inviteExpiresFlag, "expires", "", "Expire the invite after this long, e.g. 30d, 2w or 12h, or never")
+	inviteCmd.Flags().BoolVar(&inviteSyncFlag, "sync", false, "With --team or --org, also uninvite users who were invited through it and left")
 }
 
 func runInvite(cmd *cobra.Command, args []string) {
+	if inviteTeamFlag != "" || inviteOrgFlag != "" {
+		runInviteTeam(cmd, args)
+		return
+	}
+	if len(args) == 0 {
+		logger.Fatal().Msg("Provide a user or key name to invite, or use --team or --org")
+	}
+
 	name := args[0]
 	env := getEnvOrFlag(cmd)
 
@@ -43,8 +86,24 @@ func runInvite(cmd *cobra.Command, args []string) {
 		logger.Warn().Msgf("Note: Adding to root environment '%s' (overlays inherit access)", rootEnv)
 	}
 
+	err = validateRole(inviteRoleFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid role")
+	}
+
+	expiry, err := expiresAt(inviteExpiresFlag, time.Now())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid expiry")
+	}
+
 	// Check if using path flag for headless key
 	usingPath := pathFlag != ""
+	if !usingPath {
+		name, err = normalizeUserSpec(name)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid user")
+		}
+	}
 
 	// Load the keys file from root environment
 	keysFile, err := readKeysFile(rootEnv)
@@ -52,12 +111,14 @@ func runInvite(cmd *cobra.Command, args []string) {
 		logger.Fatal().Err(err).Msg("error loading keys file")
 	}
 
-	// Check if the name is already in use
-	existingKey := lo.ContainsBy(keysFile.EncryptedKeys, func(key EncryptedKey) bool {
+	// Check if the name is already in use, inviting a user again adds their new keys
+	existingKeys := lo.Filter(keysFile.EncryptedKeys, func(key EncryptedKey, index int) bool {
 		return key.Username == name
 	})
 
-	if existingKey {
+	if len(existingKeys) > 0 && (usingPath || lo.SomeBy(existingKeys, func(key EncryptedKey) bool {
+		return key.IsHeadless
+	})) {
 		// Name already exists
 		logger.Fatal().Msgf("The name '%s' is already in use. Please use a different name.", name)
 	}
@@ -67,6 +128,38 @@ func runInvite(cmd *cobra.Command, args []string) {
 		logger.Fatal().Err(err).Msg("error loading symmetric key")
 	}
 
+	requireRole(rootEnv, roleAdmin)
+
+	// New keys of an invited user get the role they already have, unless it is being changed
+	role := inviteRoleFlag
+	roleChanged := false
+	expiryChanged := false
+	if len(existingKeys) > 0 {
+		currentRole := userRole(keysFile, name)
+		if !cmd.Flags().Changed("role") {
+			role = currentRole
+		} else if role != currentRole {
+			for i, item := range keysFile.EncryptedKeys {
+				if item.Username == name {
+					keysFile.EncryptedKeys[i].Role = role
+				}
+			}
+			roleChanged = true
+		}
+
+		// Same for when they expire
+		if !cmd.Flags().Changed("expires") {
+			expiry = userExpiresAt(keysFile, name)
+		} else {
+			for i, item := range keysFile.EncryptedKeys {
+				if item.Username == name {
+					keysFile.EncryptedKeys[i].ExpiresAt = expiry
+				}
+			}
+			expiryChanged = true
+		}
+	}
+
 	var foundKeys []string
 
 	if usingPath {
@@ -76,26 +169,36 @@ func runInvite(cmd *cobra.Command, args []string) {
 			logger.Fatal().Err(err).Msgf("error reading key file %s", pathFlag)
 		}
 
-		publicKey := strings.TrimSpace(string(keyData))
+		// Drop the comment, identities are matched by the key alone
+		publicKey, err := normalizePublicKey(string(keyData))
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error reading key file %s", pathFlag)
+		}
 		foundKeys = []string{publicKey}
 	} else {
-		// Handle GitHub user
-		foundKeys, err = getKeysForGithubUsername(name)
+		// Handle user from a key source
+		foundKeys, err = getKeysForUser(name)
 		if err != nil {
-			logger.Fatal().Err(err).Msgf("error getting keys from github for %s", name)
+			logger.Fatal().Err(err).Msgf("error getting keys for %s", name)
 		}
 
-		logger.Debug().Msgf("Got %d keys from github for %s", len(foundKeys), name)
+		logger.Debug().Msgf("Got %d keys for %s", len(foundKeys), name)
 
 		if len(foundKeys) == 0 {
-			logger.Fatal().Msgf("No keys found for GitHub user %s, please add an SSH key to set up EpicEnv!", name)
+			logger.Fatal().Msgf("No keys found for user %s, please add an SSH key to set up EpicEnv!", name)
+		}
+
+		// Don't silently trust keys that appeared since they were invited
+		if newKeys, _ := diffUserKeys(keysFile, name, foundKeys); len(existingKeys) > 0 && len(newKeys) > 0 && !acceptNewFlag {
+			logNewKeys(name, newKeys)
+			logger.Fatal().Msgf("%s is already invited and has new keys, check them with %s and run again with --accept-new", name, name)
 		}
 	}
 
 	added := 0
 	for _, key := range foundKeys {
 		if lo.ContainsBy(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
-			return item.PublicKey == key
+			return samePublicKey(item.PublicKey, key)
 		}) {
 			// If it already exists, continue
 			logger.Debug().Msgf("skipping existing key like %s", key[:16])
@@ -103,35 +206,54 @@ func runInvite(cmd *cobra.Command, args []string) {
 		}
 
 		// Encrypt the sym key with their pub key
-		encSymKey, err := encryptWithPublicKey(symKey, key)
+		encKey, err := newEncryptedKey(name, key, symKey, usingPath, role)
 		if err != nil {
 			logger.Fatal().Err(err).Msg("error encrypting with public key")
 		}
-		encKey := EncryptedKey{
-			Username:           name,
-			PublicKey:          key,
-			EncryptedSharedKey: encSymKey,
-			IsHeadless:         usingPath,
-		}
+		encKey.ExpiresAt = expiry
 		keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, encKey)
 
 		added++
 	}
 
-	if added == 0 {
+	if added == 0 && !roleChanged && !expiryChanged {
 		logger.Warn().Msg("No new keys added")
 		os.Exit(0)
 	}
 
+	// Keys accepted for someone who was already invited can read the groups they are in
+	if added > 0 && len(existingKeys) > 0 {
+		err = addNewKeysToGroups(keysFile, name)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error adding the new keys to groups")
+		}
+	}
+
 	// Write the file to root environment
 	err = writeKeysFile(rootEnv, *keysFile)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error writing keys file")
 	}
 
+	if roleChanged {
+		logger.Info().Msgf("Changed the role of %s to %s", name, role)
+	}
+	if expiryChanged {
+		logger.Info().Msgf("Changed the expiry of %s to %s", name, lo.TernaryF(expiry == nil, func() string {
+			return expiresNever
+		}, func() string {
+			return expiry.Local().Format(time.DateTime)
+		}))
+	}
+	if added == 0 {
+		return
+	}
 	if usingPath {
-		logger.Info().Msgf("Added headless key '%s'", name)
+		logger.Info().Msgf("Added headless key '%s' as %s", name, role)
 	} else {
-		logger.Info().Msgf("Added GitHub user %s's keys", name)
+		logger.Info().Msgf("Added user %s's keys as %s", name, role)
+	}
+	if expiry != nil {
+		logger.Info().Msgf("The invite expires %s, run 'epicenv prune-expired' after that to remove it", expiry.Local().Format(time.DateTime))
 	}
 }
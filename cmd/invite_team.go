@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// runInviteTeam invites every member of --team or --org, writing the keys file once
+func runInviteTeam(cmd *cobra.Command, args []string) {
+	if len(args) > 0 || pathFlag != "" || (inviteTeamFlag != "" && inviteOrgFlag != "") {
+		logger.Fatal().Msg("Use either a user, --path, --team, or --org")
+	}
+
+	env := getEnvOrFlag(cmd)
+
+	err := validateRole(inviteRoleFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid role")
+	}
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Adding to root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	expiry, err := expiresAt(inviteExpiresFlag, time.Now())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid expiry")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	team, members := listGithubMembers(newGithubClient())
+	logger.Debug().Msgf("Got %d members of %s", len(members), team)
+
+	invited := 0
+	for _, login := range members {
+		if userRole(keysFile, login) != "" {
+			logger.Debug().Msgf("%s is already invited", login)
+			continue
+		}
+
+		foundKeys, err := getKeysForUser(login)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Could not get keys for %s, skipping them", login)
+			continue
+		}
+		if len(foundKeys) == 0 {
+			logger.Warn().Msgf("%s has no supported SSH keys, skipping them", login)
+			continue
+		}
+
+		added := 0
+		for _, key := range foundKeys {
+			if lo.ContainsBy(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+				return item.PublicKey == key
+			}) {
+				logger.Warn().Msgf("skipping key like %.16s for %s, it is already invited", key, login)
+				continue
+			}
+
+			encKey, err := newEncryptedKey(login, key, symKey, false, inviteRoleFlag)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("error encrypting with public key")
+			}
+			encKey.Team = team
+			encKey.ExpiresAt = expiry
+			keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, encKey)
+			added++
+		}
+
+		if added > 0 {
+			logger.Info().Msgf("Invited %s (%d keys)", login, added)
+			invited++
+		}
+	}
+
+	// Only users who were invited through this team are synced, not ones who were invited on their own
+	var left []string
+	if inviteSyncFlag {
+		left = lo.Uniq(lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+			return item.Username, item.Team == team && !lo.Contains(members, item.Username)
+		}))
+
+		if len(left) > 0 && !hasAdminWithout(keysFile, left) {
+			logger.Fatal().Msgf("Refusing to uninvite %s, nobody would be an admin", strings.Join(left, ", "))
+		}
+		removeUsers(keysFile, left)
+		for _, username := range left {
+			logger.Info().Msgf("Uninvited %s, they are no longer in %s", username, team)
+		}
+	}
+
+	if invited == 0 && len(left) == 0 {
+		logger.Info().Msgf("Everyone in %s is already invited", team)
+		return
+	}
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	if invited > 0 {
+		logger.Info().Msgf("Invited %d members of %s as %s", invited, team, inviteRoleFlag)
+	}
+	if len(left) > 0 {
+		logger.Warn().Msgf("Uninvited %d users **THIS IS NOT A REPLACEMENT FOR ROTATING SECRETS!**", len(left))
+	}
+}
+
+// listGithubMembers lists the members of --team or --org, and returns what to record as their Team
+func listGithubMembers(client *githubClient) (string, []string) {
+	if inviteOrgFlag != "" {
+		members, err := client.listOrgMembers(inviteOrgFlag)
+		if errors.Is(err, ErrNotFound) {
+			logger.Fatal().Msgf("GitHub org %s not found", inviteOrgFlag)
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error listing members of %s", inviteOrgFlag)
+		}
+		if client.token == "" && inviteSyncFlag {
+			// Private members would look like they left
+			logger.Fatal().Msg("Syncing an org needs a token in EPICENV_GITHUB_TOKEN or GITHUB_TOKEN, otherwise only public members are listed")
+		}
+		if client.token == "" {
+			logger.Warn().Msg("Only public members of the org are listed without EPICENV_GITHUB_TOKEN or GITHUB_TOKEN")
+		}
+		return inviteOrgFlag, members
+	}
+
+	org, teamSlug, found := strings.Cut(inviteTeamFlag, "/")
+	if !found || org == "" || teamSlug == "" {
+		logger.Fatal().Msgf("Invalid team '%s', use ORG/TEAM", inviteTeamFlag)
+	}
+
+	members, err := client.listTeamMembers(org, teamSlug)
+	if errors.Is(err, ErrNotFound) {
+		logger.Fatal().Msgf("GitHub team %s not found, listing team members needs a token that can read the org in EPICENV_GITHUB_TOKEN or GITHUB_TOKEN", inviteTeamFlag)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error listing members of %s", inviteTeamFlag)
+	}
+
+	return inviteTeamFlag, members
+}
@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// A keySource looks up the public keys of a user, e.g. from https://github.com/USER.keys
+type keySource interface {
+	// Name is the prefix used to select the source, e.g. gitlab in gitlab:alice
+	Name() string
+	GetKeys(username string) ([]string, error)
+}
+
+type (
+	// httpKeySource fetches BASE_URL/USER.keys, which GitHub, GitHub Enterprise, GitLab and Gitea all serve
+	httpKeySource struct {
+		name    string
+		baseURL string
+	}
+
+	// dirKeySource reads DIR/USER.keys files in authorized_keys format, e.g. for air-gapped setups
+	dirKeySource struct {
+		dir string
+	}
+)
+
+func (s httpKeySource) Name() string {
+	return s.name
+}
+
+// forgeUsernameRegexp matches the usernames GitHub, GitLab and Gitea allow, so a username can't point the request
+// at another path on the forge
+var forgeUsernameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (s httpKeySource) GetKeys(username string) ([]string, error) {
+	if s.baseURL == "" {
+		return nil, fmt.Errorf("no base URL configured for %s, set EPICENV_%s_URL", s.name, strings.ToUpper(s.name))
+	}
+	if !forgeUsernameRegexp.MatchString(username) {
+		return nil, fmt.Errorf("invalid username %q", username)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s.keys", strings.TrimSuffix(s.baseURL, "/"), url.PathEscape(username)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error in http.NewRequestWithContext: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error in http.DefaultClient.Do: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error in io.ReadAll(res.Body): %w", err)
+	}
+
+	if res.StatusCode >= 299 {
+		return nil, fmt.Errorf("high status code: %d %s", res.StatusCode, string(bodyBytes))
+	}
+
+	return parseAuthorizedKeys(bodyBytes), nil
+}
+
+func (s dirKeySource) Name() string {
+	return "dir"
+}
+
+func (s dirKeySource) GetKeys(username string) ([]string, error) {
+	if s.dir == "" {
+		return nil, fmt.Errorf("no keys directory configured, set EPICENV_KEYS_DIR")
+	}
+	if username != filepath.Base(username) || username == "." || username == ".." {
+		return nil, fmt.Errorf("invalid username %q", username)
+	}
+
+	fileBytes, err := os.ReadFile(filepath.Join(s.dir, username+".keys"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	return parseAuthorizedKeys(fileBytes), nil
+}
+
+// keySources are the available sources, base URLs can be changed for self-hosted instances
+func keySources() []keySource {
+	return []keySource{
+		httpKeySource{name: "github", baseURL: lo.CoalesceOrEmpty(os.Getenv("EPICENV_GITHUB_URL"), "https://github.com")},
+		httpKeySource{name: "gitlab", baseURL: lo.CoalesceOrEmpty(os.Getenv("EPICENV_GITLAB_URL"), "https://gitlab.com")},
+		httpKeySource{name: "gitea", baseURL: os.Getenv("EPICENV_GITEA_URL")},
+		dirKeySource{dir: os.Getenv("EPICENV_KEYS_DIR")},
+	}
+}
+
+// parseUserSpec splits a user like gitlab:alice into its key source and username.
+// Users without a prefix are GitHub users.
+func parseUserSpec(spec string) (keySource, string, error) {
+	sourceName, username, found := strings.Cut(spec, ":")
+	if !found {
+		sourceName, username = "github", spec
+	}
+	if username == "" {
+		return nil, "", fmt.Errorf("missing username in %q", spec)
+	}
+
+	source, found := lo.Find(keySources(), func(item keySource) bool {
+		return item.Name() == sourceName
+	})
+	if !found {
+		return nil, "", fmt.Errorf("unknown key source %q, use one of %s", sourceName, strings.Join(lo.Map(keySources(), func(item keySource, index int) string {
+			return item.Name()
+		}), ", "))
+	}
+
+	return source, username, nil
+}
+
+// normalizeUserSpec returns the name a user is stored as in keys.json, GitHub users keep their plain username
+func normalizeUserSpec(spec string) (string, error) {
+	source, username, err := parseUserSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	if source.Name() == "github" {
+		return username, nil
+	}
+	return source.Name() + ":" + username, nil
+}
+
+// getKeysForUser gets the supported public keys for a user like alice, github:alice, or gitlab:alice
+func getKeysForUser(spec string) ([]string, error) {
+	source, username, err := parseUserSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := source.GetKeys(username)
+	if err != nil {
+		return nil, fmt.Errorf("error getting keys from %s: %w", source.Name(), err)
+	}
+
+	return keys, nil
+}
+
+func getKeysForGithubUsername(username string) ([]string, error) {
+	return getKeysForUser("github:" + username)
+}
+
+// parseAuthorizedKeys returns the supported keys in authorized_keys format like the PublicKey of an EncryptedKey,
+// without options or comments
+func parseAuthorizedKeys(content []byte) []string {
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			logger.Debug().Err(err).Msgf("skipping unparsable key like %.16s", line)
+			continue
+		}
+
+		key := authorizedKeyString(publicKey)
+		if isSupportedKeyType(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return lo.Uniq(keys)
+}
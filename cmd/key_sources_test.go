@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testEd25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBmQxLq6d5aZf3Gc8Qr7WFImiHL5jCg7D7Vr8gpKp9lJ"
+	testECDSAKey   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDaKSPA4zaUYlgK9gQyWsaylteBw2uJZzByb/IInNLZH/6jRc+wuP76nktuw6qGKF9c0N+O5p0i+xiXq8LaiPdY="
+)
+
+func TestHTTPKeySources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice.keys":
+			// GitLab includes the key title as a comment
+			w.Write([]byte(testEd25519Key + " alice@laptop\n" + testECDSAKey + "\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("EPICENV_GITHUB_URL", server.URL)
+	t.Setenv("EPICENV_GITLAB_URL", server.URL+"/")
+	t.Setenv("EPICENV_GITEA_URL", "")
+
+	for _, spec := range []string{"alice", "github:alice", "gitlab:alice"} {
+		keys, err := getKeysForUser(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if !reflect.DeepEqual(keys, []string{testEd25519Key}) {
+			t.Fatalf("%s: unexpected keys %v", spec, keys)
+		}
+	}
+
+	if _, err := getKeysForUser("bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := getKeysForUser("gitea:alice"); err == nil {
+		t.Fatal("expected an error without EPICENV_GITEA_URL")
+	}
+	if _, err := getKeysForUser("bitbucket:alice"); err == nil {
+		t.Fatal("expected an error for an unknown key source")
+	}
+
+	// Usernames can't point the request at another path
+	for _, spec := range []string{"gitlab:../../api/v4/users", "alice/../alice", "alice?x=", "alice#", "gitlab:.alice"} {
+		if _, err := getKeysForUser(spec); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected an invalid username error, got %v", spec, err)
+		}
+	}
+}
+
+func TestDirKeySource(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "alice.keys"), []byte("# alice's keys\n\nrestrict "+testEd25519Key+" alice@laptop\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_KEYS_DIR", dir)
+
+	keys, err := getKeysForUser("dir:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{testEd25519Key}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	if _, err := getKeysForUser("dir:bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := getKeysForUser("dir:../alice"); err == nil {
+		t.Fatal("expected an error for a path in the username")
+	}
+}
+
+func TestNormalizeUserSpec(t *testing.T) {
+	for spec, want := range map[string]string{
+		"alice":        "alice",
+		"github:alice": "alice",
+		"gitlab:alice": "gitlab:alice",
+		"dir:alice":    "dir:alice",
+	} {
+		got, err := normalizeUserSpec(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", spec, got, want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen [name]",
+	Short: "Generate a new headless key and add it to the EpicEnv",
+	Long: `Generate a new keypair and add it to the EpicEnv as a headless key, e.g. for CI.
+
+The key is a reader by default, since CI usually only needs to read values.
+
+The private key is printed once to stdout (or written to --out), ready to be stored as a CI secret
+and used with EPICENV_PRIVATE_KEY. It is never stored in the .epicenv directory, so if you lose it,
+uninvite the key and generate a new one.
+
+Examples:
+  epicenv keygen github-actions                    # Print the private key
+  epicenv keygen github-actions --out ci_key       # Write the private key to a file
+  epicenv keygen legacy-ci --type rsa              # Generate an RSA key instead of Ed25519
+  epicenv keygen deploy-bot --role writer          # A key that can also change shared values
+  epicenv keygen preview-ci --expires 7d           # A temporary key, see prune-expired`,
+	Run:  runKeygen,
+	Args: cobra.ExactArgs(1),
+}
+
+var (
+	keygenTypeFlag    string
+	keygenOutFlag     string
+	keygenRoleFlag    string
+	keygenExpiresFlag string
+)
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().StringVar(&keygenTypeFlag, "type", "ed25519", "Key type to generate, ed25519 or rsa")
+	keygenCmd.Flags().StringVar(&keygenOutFlag, "out", "", "Write the private key to this file instead of stdout")
+	keygenCmd.Flags().StringVar(&keygenRoleFlag, "role", roleReader, "Role of the key: admin, writer or reader")
+	keygenCmd.Flags().StringVar(&keygenExpiresFlag, "expires", "", "Expire the key after this long, e.g. 30d, 2w or 12h")
+}
+
+func runKeygen(cmd *cobra.Command, args []string) {
+	name := args[0]
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Adding to root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	err = validateRole(keygenRoleFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid role")
+	}
+
+	expiry, err := expiresAt(keygenExpiresFlag, time.Now())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid expiry")
+	}
+
+	if keygenOutFlag != "" {
+		inside, err := isInsideEpicEnvDir(keygenOutFlag)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error checking output path")
+		}
+		if inside {
+			logger.Fatal().Msg("Refusing to write a private key into the .epicenv directory")
+		}
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading keys file")
+	}
+
+	if lo.ContainsBy(keysFile.EncryptedKeys, func(key EncryptedKey) bool {
+		return key.Username == name
+	}) {
+		logger.Fatal().Msgf("The name '%s' is already in use. Please use a different name.", name)
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	publicKey, privateKeyPEM, err := generateKeyPair(keygenTypeFlag, "epicenv "+name)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error generating key")
+	}
+
+	encKey, err := newEncryptedKey(name, publicKey, symKey, true, keygenRoleFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error encrypting with public key")
+	}
+	encKey.ExpiresAt = expiry
+
+	// Write the private key out first, so we never invite a key that nobody has
+	if keygenOutFlag != "" {
+		err = writePrivateKeyFile(keygenOutFlag, privateKeyPEM)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error writing private key")
+		}
+	}
+
+	keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, encKey)
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		if keygenOutFlag != "" {
+			os.Remove(keygenOutFlag)
+		}
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	if keygenOutFlag != "" {
+		logger.Info().Msgf("Added headless key '%s' as %s, the private key was written to %s", name, keygenRoleFlag, keygenOutFlag)
+	} else {
+		fmt.Print(string(privateKeyPEM))
+		logger.Info().Msgf("Added headless key '%s' as %s, store the private key above now, it will not be shown again", name, keygenRoleFlag)
+	}
+	logger.Info().Msgf("Public key: %s", publicKey)
+}
+
+// generateKeyPair generates a key of keyType, returning the public key like the PublicKey
+// of an EncryptedKey and the OpenSSH PEM encoded private key
+func generateKeyPair(keyType, comment string) (string, []byte, error) {
+	var privateKey crypto.PrivateKey
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q, use ed25519 or rsa", keyType)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating %s key: %w", keyType, err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("error in ssh.NewSignerFromKey: %w", err)
+	}
+
+	pemBlock, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return "", nil, fmt.Errorf("error in ssh.MarshalPrivateKey: %w", err)
+	}
+
+	return authorizedKeyString(signer.PublicKey()), pem.EncodeToMemory(pemBlock), nil
+}
+
+// writePrivateKeyFile writes a private key only readable by us, without overwriting anything
+func writePrivateKeyFile(filePath string, privateKeyPEM []byte) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error in os.OpenFile: %w", err)
+	}
+
+	_, err = f.Write(privateKeyPEM)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("error writing %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// isInsideEpicEnvDir checks whether filePath would be inside the .epicenv directory
+func isInsideEpicEnvDir(filePath string) (bool, error) {
+	epicEnvPath, err := filepath.Abs(getEpicEnvPath())
+	if err != nil {
+		return false, fmt.Errorf("error in filepath.Abs: %w", err)
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return false, fmt.Errorf("error in filepath.Abs: %w", err)
+	}
+
+	// Resolve symlinks of the directory, since the file itself doesn't exist yet
+	if resolved, err := filepath.EvalSymlinks(epicEnvPath); err == nil {
+		epicEnvPath = resolved
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("error in filepath.EvalSymlinks: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(absPath)); err == nil {
+		absPath = filepath.Join(resolved, filepath.Base(absPath))
+	}
+
+	rel, err := filepath.Rel(epicEnvPath, absPath)
+	if err != nil {
+		return false, nil
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))), nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	for _, keyType := range []string{"ed25519", "rsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			publicKey, privateKeyPEM, err := generateKeyPair(keyType, "epicenv test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kp, err := identityKeyPair("test", privateKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kp.publicKeyContent != publicKey {
+				t.Fatalf("public key mismatch: got %q, want %q", kp.publicKeyContent, publicKey)
+			}
+
+			testData := []byte("Hello, World!")
+			encrypted, algorithm, err := encryptWithPublicKey(testData, publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := decryptWithPrivateKey(encrypted, algorithm, kp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(testData, decrypted) {
+				t.Errorf("decrypted data does not match original data")
+			}
+		})
+	}
+
+	if _, _, err := generateKeyPair("dsa", ""); err == nil {
+		t.Fatal("expected an error for an unsupported key type")
+	}
+}
@@ -1,29 +1,48 @@
 package cmd
 
 import (
-	"context"
+	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound            = errors.New("not found")
+	ErrFingerprintMismatch = errors.New("key does not match its fingerprint")
 )
 
 type keyPair struct {
 	publicKeyContent string
-	privateKeyPath   string
+	// privateKeyPath is where the private key is, or where privateKeyContent came from
+	privateKeyPath string
+	// privateKeyContent is set for keys that were not read from a file, like EPICENV_PRIVATE_KEY
+	privateKeyContent []byte
 }
 
+// findPrivateKeysForPublicKeys finds private keys for pubKeys. If an identity is given with
+// --identity, EPICENV_IDENTITY, or EPICENV_PRIVATE_KEY, only those are used. Otherwise $HOME/.ssh is searched.
 func findPrivateKeysForPublicKeys(pubKeys []string) []keyPair {
+	identities, err := getIdentityKeyPairs()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to load identity")
+		return nil
+	}
+	if len(identities) > 0 {
+		return lo.FilterMap(identities, func(item keyPair, index int) (keyPair, bool) {
+			// Use the invited key as it was written, so it can be found among the invited keys
+			match, found := matchPublicKey(pubKeys, item.publicKeyContent)
+			item.publicKeyContent = match
+			return item, found
+		})
+	}
+
 	homedir, err := os.UserHomeDir()
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to get home dir")
@@ -59,7 +78,8 @@ func findPrivateKeysForPublicKeys(pubKeys []string) []keyPair {
 		}
 		keyContent := strings.Join(keyParts[:2], " ") // remove any hostname info after
 
-		if !lo.Contains(pubKeys, keyContent) {
+		keyContent, found := matchPublicKey(pubKeys, keyContent)
+		if !found {
 			continue
 		}
 
@@ -79,39 +99,128 @@ func findPrivateKeysForPublicKeys(pubKeys []string) []keyPair {
 	return keys
 }
 
-func getKeysForGithubUsername(username string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
-	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://github.com/%s.keys", username), nil)
+// getIdentityKeyPairs loads the private keys that were explicitly given, e.g. for CI
+func getIdentityKeyPairs() ([]keyPair, error) {
+	var identities []keyPair
+
+	identityPath := lo.CoalesceOrEmpty(identityFlag, os.Getenv("EPICENV_IDENTITY"))
+	if identityPath != "" {
+		privateKeyContent, err := os.ReadFile(identityPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading identity %s: %w", identityPath, err)
+		}
+
+		kp, err := identityKeyPair(identityPath, privateKeyContent)
+		if err != nil {
+			return nil, err
+		}
+		// Read it again from the path when it's used, like keys from $HOME/.ssh
+		kp.privateKeyContent = nil
+		identities = append(identities, kp)
+	}
+
+	if privateKeyContent := os.Getenv("EPICENV_PRIVATE_KEY"); privateKeyContent != "" {
+		kp, err := identityKeyPair("$EPICENV_PRIVATE_KEY", []byte(privateKeyContent))
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, kp)
+	}
+
+	return identities, nil
+}
+
+// identityKeyPair works out the public key for a private key
+func identityKeyPair(name string, privateKeyContent []byte) (keyPair, error) {
+	kp := keyPair{
+		privateKeyPath:    name,
+		privateKeyContent: privateKeyContent,
+	}
+
+	// Passphrase protected OpenSSH keys still have the public key in the clear
+	var passphraseMissing *ssh.PassphraseMissingError
+	_, err := ssh.ParseRawPrivateKey(privateKeyContent)
+	if errors.As(err, &passphraseMissing) && passphraseMissing.PublicKey != nil {
+		kp.publicKeyContent = authorizedKeyString(passphraseMissing.PublicKey)
+		return kp, nil
+	}
+
+	privateKey, err := parsePrivateKey(kp)
 	if err != nil {
-		return nil, fmt.Errorf("error in http.NewRequestWithContext: %w", err)
+		return keyPair{}, fmt.Errorf("error parsing identity %s: %w", name, err)
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	if edKey, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *edKey
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
 	if err != nil {
-		return nil, fmt.Errorf("error in http.DefaultClient.Do: %w", err)
+		return keyPair{}, fmt.Errorf("error getting public key for identity %s: %w", name, err)
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode == 404 {
-		return nil, ErrNotFound
+	kp.publicKeyContent = authorizedKeyString(signer.PublicKey())
+	return kp, nil
+}
+
+// samePublicKey checks whether two authorized_keys style public keys are the same key, ignoring their comments
+func samePublicKey(a, b string) bool {
+	parsedA, _, _, _, errA := ssh.ParseAuthorizedKey([]byte(a))
+	parsedB, _, _, _, errB := ssh.ParseAuthorizedKey([]byte(b))
+	if errA != nil || errB != nil {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
 	}
+	return bytes.Equal(parsedA.Marshal(), parsedB.Marshal())
+}
+
+// matchPublicKey finds the key in pubKeys that is the same key as publicKey
+func matchPublicKey(pubKeys []string, publicKey string) (string, bool) {
+	return lo.Find(pubKeys, func(item string) bool {
+		return samePublicKey(item, publicKey)
+	})
+}
 
-	bodyBytes, err := io.ReadAll(res.Body)
+// normalizePublicKey formats an authorized_keys style public key without its comment, like keys from key sources
+func normalizePublicKey(publicKey string) (string, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
 	if err != nil {
-		return nil, fmt.Errorf("error in io.ReadAll(res.Body): %w", err)
+		return "", fmt.Errorf("error parsing public key: %w", err)
 	}
+	return authorizedKeyString(parsed), nil
+}
 
-	if res.StatusCode >= 299 {
-		return nil, fmt.Errorf("high status code: %d %s", err, string(bodyBytes))
+// keyFingerprint returns the SHA256 fingerprint of an authorized_keys style public key, like ssh-keygen -l
+func keyFingerprint(publicKey string) (string, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("error parsing public key: %w", err)
 	}
 
-	keys := lo.Map(strings.Split(string(bodyBytes), "\n"), func(item string, index int) string {
-		return strings.TrimSpace(item)
-	})
-	keys = lo.Filter(keys, func(item string, index int) bool {
-		return item != "" && strings.HasPrefix(item, "ssh-rsa")
-	})
+	return ssh.FingerprintSHA256(parsed), nil
+}
+
+// checkKeyFingerprint returns the fingerprint of an invited key, making sure it still matches the one
+// it was invited with. Keys invited before fingerprints were stored are fingerprinted now.
+func checkKeyFingerprint(key EncryptedKey) (string, error) {
+	fingerprint, err := keyFingerprint(key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if key.Fingerprint != "" && key.Fingerprint != fingerprint {
+		return "", fmt.Errorf("%w: invited as %s but the key is %s", ErrFingerprintMismatch, key.Fingerprint, fingerprint)
+	}
+
+	return fingerprint, nil
+}
+
+// isSupportedKeyType checks whether we know how to encrypt to an authorized_keys style public key
+func isSupportedKeyType(publicKey string) bool {
+	return lo.Contains(supportedKeyTypes, keyType(publicKey))
+}
+
+var supportedKeyTypes = []string{"ssh-rsa", "ssh-ed25519"}
 
-	return keys, nil
+// keyType returns the algorithm prefix of an authorized_keys style public key, e.g. ssh-ed25519
+func keyType(publicKey string) string {
+	return strings.SplitN(strings.TrimSpace(publicKey), " ", 2)[0]
 }
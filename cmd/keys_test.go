@@ -1,7 +1,17 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const ghUsername = "danthegoodman1"
@@ -30,3 +40,150 @@ func TestFindFirstPrivateKeyForPublicKey(t *testing.T) {
 
 	t.Log("found private key:", keyPairs)
 }
+
+func TestIdentityKeyPairs(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := authorizedKeyString(sshPub)
+	privateKeyContent := pem.EncodeToMemory(pemBlock)
+
+	testData := []byte("Hello, World!")
+	encrypted, algorithm, err := encryptWithPublicKey(testData, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("EPICENV_PRIVATE_KEY", func(t *testing.T) {
+		t.Setenv("EPICENV_PRIVATE_KEY", string(privateKeyContent))
+
+		keyPairs := findPrivateKeysForPublicKeys([]string{"ssh-ed25519 AAAAnotus", publicKey})
+		if len(keyPairs) != 1 {
+			t.Fatalf("expected 1 key pair, got %d", len(keyPairs))
+		}
+
+		decrypted, err := decryptWithPrivateKey(encrypted, algorithm, keyPairs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(testData, decrypted) {
+			t.Errorf("decrypted data does not match original data")
+		}
+	})
+
+	t.Run("EPICENV_IDENTITY", func(t *testing.T) {
+		// No .pub next to it, so the public key has to come from the private key
+		privateKeyPath := filepath.Join(t.TempDir(), "ci_key")
+		if err := os.WriteFile(privateKeyPath, privateKeyContent, 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("EPICENV_IDENTITY", privateKeyPath)
+
+		keyPairs := findPrivateKeysForPublicKeys([]string{publicKey})
+		if len(keyPairs) != 1 {
+			t.Fatalf("expected 1 key pair, got %d", len(keyPairs))
+		}
+
+		decrypted, err := decryptWithPrivateKey(encrypted, algorithm, keyPairs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(testData, decrypted) {
+			t.Errorf("decrypted data does not match original data")
+		}
+	})
+
+	t.Run("not invited", func(t *testing.T) {
+		t.Setenv("EPICENV_PRIVATE_KEY", string(privateKeyContent))
+
+		keyPairs := findPrivateKeysForPublicKeys([]string{"ssh-ed25519 AAAAnotus"})
+		if len(keyPairs) != 0 {
+			t.Fatalf("expected no key pairs, got %d", len(keyPairs))
+		}
+	})
+}
+
+func TestInviteKeyWithComment(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_PRIVATE_KEY", string(pem.EncodeToMemory(pemBlock)))
+
+	// Like a .pub file from ssh-keygen
+	withComment := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " ci@build-host\n"
+	invited, err := normalizePublicKey(withComment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invited != authorizedKeyString(sshPub) {
+		t.Errorf("normalizePublicKey() = %q, want it without the comment", invited)
+	}
+
+	symKey := generateAESKey()
+	// Keys invited before they were normalized still have their comment
+	for _, publicKey := range []string{invited, strings.TrimSpace(withComment)} {
+		encKey, err := newEncryptedKey("ci", publicKey, symKey, true, roleReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decrypted, err := unwrapWithLocalKeys([]EncryptedKey{encKey})
+		if err != nil {
+			t.Fatalf("unwrapping for %q: %v", publicKey, err)
+		}
+		if !bytes.Equal(decrypted, symKey) {
+			t.Errorf("unwrapped key for %q does not match", publicKey)
+		}
+	}
+}
+
+func TestCheckKeyFingerprint(t *testing.T) {
+	publicKey, _, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encKey, err := newEncryptedKey("alice", publicKey, generateAESKey(), false, roleWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := checkKeyFingerprint(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != encKey.Fingerprint {
+		t.Fatalf("fingerprint mismatch: got %s, want %s", fingerprint, encKey.Fingerprint)
+	}
+
+	// Keys invited before fingerprints were stored
+	if _, err := checkKeyFingerprint(EncryptedKey{PublicKey: publicKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	encKey.PublicKey = otherKey
+	if _, err := checkKeyFingerprint(encKey); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("expected ErrFingerprintMismatch, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"strings"
+	"time"
+
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
@@ -8,8 +11,8 @@ import (
 // listInvitesCmd represents the list-invites command
 var listInvitesCmd = &cobra.Command{
 	Use:   "list-invites",
-	Short: "List all GitHub users and headless keys invited to the environment",
-	Long: `List all GitHub users and headless keys that have been invited to the environment.
+	Short: "List all users and headless keys invited to the environment",
+	Long: `List all users and headless keys that have been invited to the environment.
 
 Example:
   epicenv list-invites -e prod`,
@@ -35,6 +38,12 @@ func runListInvites(cmd *cobra.Command, args []string) {
 		logger.Fatal().Err(err).Msg("error reading keys file")
 	}
 
+	_, recoveryEnabled := findRecoveryKey(keysFile)
+	// The recovery entry isn't an invite, hide it without touching the split or groups
+	keysFile.EncryptedKeys = lo.Reject(keysFile.EncryptedKeys, func(item EncryptedKey, _ int) bool {
+		return item.IsRecovery
+	})
+
 	if len(keysFile.EncryptedKeys) == 0 {
 		logger.Info().Msgf("No users or keys are invited to environment '%s'", env)
 		return
@@ -45,26 +54,28 @@ func runListInvites(cmd *cobra.Command, args []string) {
 		return key.Username
 	}))
 
-	// Get count of keys per user and track which are headless
+	// Get count and types of keys per user and track which are headless
 	userKeyCounts := make(map[string]int)
+	userKeyTypes := make(map[string][]string)
 	userIsHeadless := make(map[string]bool)
 
 	for _, key := range keysFile.EncryptedKeys {
 		userKeyCounts[key.Username]++
+		userKeyTypes[key.Username] = lo.Uniq(append(userKeyTypes[key.Username], keyType(key.PublicKey)))
 		if key.IsHeadless {
 			userIsHeadless[key.Username] = true
 		}
 	}
 
-	// Separate GitHub users from headless keys
-	var githubUsers []string
+	// Separate users from headless keys
+	var users []string
 	var headlessKeys []string
 
 	for _, username := range usernames {
 		if userIsHeadless[username] {
 			headlessKeys = append(headlessKeys, username)
 		} else {
-			githubUsers = append(githubUsers, username)
+			users = append(users, username)
 		}
 	}
 
@@ -74,17 +85,46 @@ func runListInvites(cmd *cobra.Command, args []string) {
 		logger.Info().Msgf("Keys invited to environment '%s':", env)
 	}
 
-	if len(githubUsers) > 0 {
-		logger.Info().Msg("GitHub Users:")
-		for _, username := range githubUsers {
-			logger.Info().Msgf("- %s (%d keys)", username, userKeyCounts[username])
+	now := time.Now()
+	if len(users) > 0 {
+		logger.Info().Msg("Users:")
+		for _, username := range users {
+			logger.Info().Msgf("- %s [%s] (%d keys: %s)%s", username, userRole(keysFile, username), userKeyCounts[username], strings.Join(userKeyTypes[username], ", "), formatExpiry(keysFile, username, now))
+			logKeyFingerprints(keysFile, username)
 		}
 	}
 
 	if len(headlessKeys) > 0 {
 		logger.Info().Msg("Headless Keys:")
 		for _, keyname := range headlessKeys {
-			logger.Info().Msgf("- %s (%d keys)", keyname, userKeyCounts[keyname])
+			logger.Info().Msgf("- %s [%s] (%d keys: %s)%s", keyname, userRole(keysFile, keyname), userKeyCounts[keyname], strings.Join(userKeyTypes[keyname], ", "), formatExpiry(keysFile, keyname, now))
+			logKeyFingerprints(keysFile, keyname)
+		}
+	}
+
+	if recoveryEnabled {
+		logger.Info().Msg("Recovery is enabled with a passphrase, see 'epicenv recovery --help'")
+	}
+	if keysFile.Split != nil {
+		holders := lo.Uniq(lo.Map(keysFile.Split.Shares, func(item EncryptedKey, index int) string {
+			return item.Username
+		}))
+		logger.Info().Msgf("The key is split among %s, any %d of them can recover it", strings.Join(holders, ", "), keysFile.Split.Threshold)
+	}
+}
+
+// logKeyFingerprints lists the fingerprints of the keys of username, so they can be compared with `ssh-keygen -l`
+func logKeyFingerprints(keysFile *KeysFile, username string) {
+	for _, key := range keysFile.EncryptedKeys {
+		if key.Username != username {
+			continue
+		}
+
+		fingerprint, err := checkKeyFingerprint(key)
+		if err != nil {
+			logger.Error().Err(err).Msgf("    %s", keyType(key.PublicKey))
+			continue
 		}
+		logger.Info().Msgf("    %s %s", keyType(key.PublicKey), fingerprint)
 	}
 }
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log [KEY]",
+	Short: "Show when the values of an environment changed",
+	Long: `Show the commits that changed the values of an environment, or only KEY, newest first, with the values
+before and after. Changes that are not committed yet are included.
+
+Values are decrypted with the current key, or the previous keys if the key was rotated since, so values that
+were only encrypted again are not changes. Only the values of the environment itself are included, not of the
+environments it overlays. --mode is how values are shown: full, masked or hash, see 'epicenv git-textconv --help'.
+
+Examples:
+  epicenv log -e prod
+  epicenv log DATABASE_URL -e prod --mode full`,
+	Run:  runLog,
+	Args: cobra.MaximumNArgs(1),
+}
+
+var logModeFlag string
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+	logCmd.Flags().StringVar(&logModeFlag, "mode", diffModeMasked, "How to show values: full, masked or hash")
+}
+
+type (
+	// historyValue is a value at one revision, compared by its plaintext when we can decrypt it
+	historyValue struct {
+		compare string
+		shown   string
+	}
+
+	// historyChange is a value that was added, removed or changed between two revisions
+	historyChange struct {
+		Name string
+		// Old and New are the values as shown, Old is empty if it was added and New if it was removed
+		Old     string
+		New     string
+		Added   bool
+		Removed bool
+	}
+)
+
+func runLog(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+	requireDiffMode(logModeFlag)
+
+	keys, err := loadEnvKeyring(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	commits, err := gitLog(getEpicEnvPath(), path.Join(env, "secrets.json"))
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading the git history, is the .epicenv directory in a git repository?")
+	}
+
+	type logEntry struct {
+		// Commit is empty for changes that are not committed yet
+		Commit  gitCommit
+		Changes []historyChange
+	}
+
+	isKey := func(change historyChange, index int) bool {
+		return len(args) == 0 || change.Name == args[0]
+	}
+
+	// Values at every commit we looked at, by hash
+	valuesAt := make(map[string]map[string]historyValue)
+	readValues := func(rev string) map[string]historyValue {
+		if values, found := valuesAt[rev]; found {
+			return values
+		}
+		values := map[string]historyValue{}
+		secretsFile, err := readSecretsAt(rev, env)
+		if err == nil {
+			values = historyValues(secretsFile, keys, logModeFlag)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			logger.Fatal().Err(err).Msgf("error reading secrets file at %s", rev)
+		}
+		valuesAt[rev] = values
+		return values
+	}
+
+	// Commits are compared with their parents, merges only show values that differ from every parent
+	var entries []logEntry
+	for _, commit := range commits {
+		after := readValues(commit.Hash)
+		var changes []historyChange
+		for i, parent := range lo.Ternary(len(commit.Parents) > 0, commit.Parents, []string{""}) {
+			before := map[string]historyValue{}
+			if parent != "" {
+				before = readValues(parent)
+			}
+			parentChanges := lo.Filter(diffHistoryValues(before, after), isKey)
+			if i == 0 {
+				changes = parentChanges
+				continue
+			}
+			changes = lo.Filter(changes, func(change historyChange, index int) bool {
+				return lo.ContainsBy(parentChanges, func(parentChange historyChange) bool {
+					return parentChange.Name == change.Name
+				})
+			})
+		}
+
+		if len(changes) > 0 {
+			entries = append(entries, logEntry{Commit: commit, Changes: changes})
+		}
+	}
+
+	current := map[string]historyValue{}
+	secretsFile, err := readSecretsFile(env, false)
+	if err == nil {
+		current = historyValues(secretsFile, keys, logModeFlag)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		logger.Fatal().Err(err).Msg("error reading secrets file")
+	}
+	if changes := lo.Filter(diffHistoryValues(readValues("HEAD"), current), isKey); len(changes) > 0 {
+		entries = append(entries, logEntry{Changes: changes})
+	}
+
+	if len(entries) == 0 {
+		what := "any values"
+		if len(args) > 0 {
+			what = args[0]
+		}
+		logger.Info().Msgf("No changes to %s in %s", what, env)
+		return
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Commit.Hash == "" {
+			fmt.Println("Not committed yet")
+		} else {
+			fmt.Printf("%.8s  %s  %s\n", entry.Commit.Hash, entry.Commit.Time.Format(time.DateTime), entry.Commit.Author)
+		}
+
+		for _, change := range entry.Changes {
+			switch {
+			case change.Added:
+				fmt.Printf("  + %s=%s\n", change.Name, change.New)
+			case change.Removed:
+				fmt.Printf("  - %s\n", change.Name)
+			default:
+				fmt.Printf("  ~ %s: %s -> %s\n", change.Name, change.Old, change.New)
+			}
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+	}
+}
+
+// readSecretsAt reads the shared secrets of env at commit, os.ErrNotExist if they weren't committed yet
+func readSecretsAt(commit, env string) (*SecretsFile, error) {
+	fileBytes, err := gitShow(getEpicEnvPath(), commit, path.Join(env, "secrets.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var secretsFile SecretsFile
+	err = json.Unmarshal(fileBytes, &secretsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling secrets file at %s: %w", commit, err)
+	}
+
+	return &secretsFile, nil
+}
+
+// historyValues decrypts the values of secretsFile with keys to compare them, and shows them in mode
+func historyValues(secretsFile *SecretsFile, keys *envKeyring, mode string) map[string]historyValue {
+	values := make(map[string]historyValue)
+	for _, item := range secretsFile.Secrets {
+		value, _, ok := keys.decrypt(item)
+		switch {
+		case item.Personal:
+			values[item.Name] = historyValue{compare: "personal", shown: "(personal)"}
+		case !ok:
+			values[item.Name] = historyValue{compare: "encrypted " + item.Value, shown: "(can't decrypt)"}
+		default:
+			values[item.Name] = historyValue{compare: "value " + item.Group + " " + value, shown: keys.display(mode, value)}
+		}
+	}
+	return values
+}
+
+// diffHistoryValues returns the values that were added, removed or changed from before to after, sorted by name
+func diffHistoryValues(before, after map[string]historyValue) []historyChange {
+	names := lo.Uniq(append(lo.Keys(before), lo.Keys(after)...))
+	slices.Sort(names)
+
+	var changes []historyChange
+	for _, name := range names {
+		old, existed := before[name]
+		current, exists := after[name]
+		switch {
+		case !existed:
+			changes = append(changes, historyChange{Name: name, New: current.shown, Added: true})
+		case !exists:
+			changes = append(changes, historyChange{Name: name, Old: old.shown, Removed: true})
+		case old.compare != current.compare:
+			changes = append(changes, historyChange{Name: name, Old: old.shown, New: current.shown})
+		}
+	}
+
+	return changes
+}
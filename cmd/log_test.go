@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffHistoryValues(t *testing.T) {
+	value := func(compare string) historyValue {
+		return historyValue{compare: compare, shown: "shown " + compare}
+	}
+
+	before := map[string]historyValue{
+		"SAME":    value("a"),
+		"CHANGED": value("b"),
+		"REMOVED": value("c"),
+	}
+	after := map[string]historyValue{
+		"SAME":    value("a"),
+		"CHANGED": value("b2"),
+		"ADDED":   value("d"),
+	}
+
+	want := []historyChange{
+		{Name: "ADDED", New: "shown d", Added: true},
+		{Name: "CHANGED", Old: "shown b", New: "shown b2"},
+		{Name: "REMOVED", Old: "shown c", Removed: true},
+	}
+	if got := diffHistoryValues(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffHistoryValues() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseGitCommit(t *testing.T) {
+	got, err := parseGitCommit("abc\x1f1700000000\x1fp1 p2\x1fJane Doe\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := gitCommit{Hash: "abc", Time: time.Unix(1700000000, 0), Author: "Jane Doe", Parents: []string{"p1", "p2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGitCommit() = %+v, want %+v", got, want)
+	}
+
+	if _, err := parseGitCommit("abc 1700000000"); err == nil {
+		t.Errorf("parseGitCommit() of a bad line did not error")
+	}
+}
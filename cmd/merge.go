@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"reflect"
+
+	"github.com/samber/lo"
+)
+
+// mergeSide is which side of a merge a conflict was resolved with
+type mergeSide int
+
+const (
+	sideNone mergeSide = iota
+	sideOurs
+	sideTheirs
+)
+
+// mergeResolver picks a side for an entry both sides changed differently, nil for entries that are missing on a side.
+// sideNone leaves the conflict unresolved.
+type mergeResolver[T any] func(id string, base, ours, theirs *T) mergeSide
+
+// mergeEntries three-way merges entries identified by id. Changes made by only one side are taken from it, including
+// removals. Entries both sides changed differently are resolved with resolve, or keep ours and are returned as unresolved.
+// Ours come first in the result, then the entries only theirs added.
+func mergeEntries[T any](base, ours, theirs []T, id func(T) string, same func(a, b T) bool, resolve mergeResolver[T]) ([]T, []string) {
+	find := func(entries []T, entryID string) *T {
+		entry, found := lo.Find(entries, func(item T) bool {
+			return id(item) == entryID
+		})
+		return lo.Ternary(found, &entry, nil)
+	}
+	sameEntry := func(a, b *T) bool {
+		if a == nil || b == nil {
+			return a == nil && b == nil
+		}
+		return same(*a, *b)
+	}
+
+	var ids []string
+	for _, entry := range append(append([]T{}, ours...), theirs...) {
+		ids = append(ids, id(entry))
+	}
+
+	var merged []T
+	var unresolved []string
+	for _, entryID := range lo.Uniq(ids) {
+		baseEntry, oursEntry, theirsEntry := find(base, entryID), find(ours, entryID), find(theirs, entryID)
+
+		result := oursEntry
+		switch {
+		case sameEntry(oursEntry, theirsEntry), sameEntry(baseEntry, theirsEntry):
+		case sameEntry(baseEntry, oursEntry):
+			result = theirsEntry
+		default:
+			side := sideNone
+			if resolve != nil {
+				side = resolve(entryID, baseEntry, oursEntry, theirsEntry)
+			}
+			switch side {
+			case sideTheirs:
+				result = theirsEntry
+			case sideNone:
+				unresolved = append(unresolved, entryID)
+			}
+		}
+
+		if result != nil {
+			merged = append(merged, *result)
+		}
+	}
+
+	return merged, unresolved
+}
+
+// mergeValue three-way merges a single value, which conflicts if both sides changed it differently
+func mergeValue[T any](base, ours, theirs T, resolve func() mergeSide) (T, bool) {
+	switch {
+	case reflect.DeepEqual(ours, theirs), reflect.DeepEqual(base, theirs):
+		return ours, true
+	case reflect.DeepEqual(base, ours):
+		return theirs, true
+	}
+
+	side := sideNone
+	if resolve != nil {
+		side = resolve()
+	}
+	return lo.Ternary(side == sideTheirs, theirs, ours), side != sideNone
+}
+
+// mergeSecretsFiles three-way merges the values of a secrets file, sorted like writeSecretsFile. same tells if two values
+// with the same name are the same, even if they were encrypted again. Returns the names of values that were left unresolved with ours.
+func mergeSecretsFiles(base, ours, theirs *SecretsFile, same func(a, b EncryptedSecret) bool, resolve mergeResolver[EncryptedSecret]) (*SecretsFile, []string) {
+	secrets, unresolved := mergeEntries(base.Secrets, ours.Secrets, theirs.Secrets, func(item EncryptedSecret) string {
+		return item.Name
+	}, same, resolve)
+
+	return &SecretsFile{Secrets: sortSecrets(secrets), Generation: ours.Generation}, unresolved
+}
+
+// keysMergeResolver resolves the conflicts in a keys file, for the invited keys, the groups and the split key
+type keysMergeResolver struct {
+	keys  mergeResolver[EncryptedKey]
+	group mergeResolver[Group]
+	split func(base, ours, theirs *SplitKey) mergeSide
+}
+
+// encryptedKeyID identifies an invited key for merging, recovery entries don't have a public key
+func encryptedKeyID(item EncryptedKey) string {
+	return lo.Ternary(item.IsRecovery, recoveryUsername, item.PublicKey)
+}
+
+// mergeKeysFiles three-way merges keys files. Invited keys, groups and their members are merged one by one.
+// Both sides rotating the key can't be resolved. Returns descriptions of what was left unresolved with ours.
+func mergeKeysFiles(base, ours, theirs *KeysFile, resolve keysMergeResolver) (*KeysFile, []string) {
+	var unresolved []string
+	sameKey := func(a, b EncryptedKey) bool {
+		return reflect.DeepEqual(a, b)
+	}
+
+	merged := &KeysFile{Version: max(ours.Version, theirs.Version), SecretsVersion: max(ours.SecretsVersion, theirs.SecretsVersion)}
+
+	keys, unresolvedKeys := mergeEntries(base.EncryptedKeys, ours.EncryptedKeys, theirs.EncryptedKeys, encryptedKeyID, sameKey, resolve.keys)
+	merged.EncryptedKeys = keys
+	for _, entryID := range unresolvedKeys {
+		unresolved = append(unresolved, "key "+describeKeyID(entryID, ours, theirs))
+	}
+
+	// The symmetric key is whichever side rotated it
+	type keyGeneration struct {
+		Generation   int
+		PreviousKeys []PreviousKey
+	}
+	generation, ok := mergeValue(
+		keyGeneration{base.Generation, base.PreviousKeys},
+		keyGeneration{ours.Generation, ours.PreviousKeys},
+		keyGeneration{theirs.Generation, theirs.PreviousKeys},
+		nil,
+	)
+	merged.Generation, merged.PreviousKeys = generation.Generation, generation.PreviousKeys
+	if !ok {
+		unresolved = append(unresolved, "the key, both sides rotated it")
+	}
+
+	// Members of a group both sides changed are merged, unless both sides created it with a different key
+	groups, unresolvedGroups := mergeEntries(base.Groups, ours.Groups, theirs.Groups, func(item Group) string {
+		return item.Name
+	}, func(a, b Group) bool {
+		return reflect.DeepEqual(a, b)
+	}, nil)
+	for _, name := range unresolvedGroups {
+		baseGroup, _ := lo.Find(base.Groups, func(item Group) bool { return item.Name == name })
+		oursGroup, inOurs := lo.Find(ours.Groups, func(item Group) bool { return item.Name == name })
+		theirsGroup, inTheirs := lo.Find(theirs.Groups, func(item Group) bool { return item.Name == name })
+
+		if inOurs && inTheirs && baseGroup.Name != "" {
+			members, unresolvedMembers := mergeEntries(baseGroup.EncryptedKeys, oursGroup.EncryptedKeys, theirsGroup.EncryptedKeys, encryptedKeyID, sameKey, resolve.keys)
+			if len(unresolvedMembers) == 0 {
+				replaceGroup(groups, Group{Name: name, EncryptedKeys: members})
+				continue
+			}
+		}
+
+		side := sideNone
+		if resolve.group != nil {
+			side = resolve.group(name, lo.Ternary(baseGroup.Name != "", &baseGroup, nil), lo.Ternary(inOurs, &oursGroup, nil), lo.Ternary(inTheirs, &theirsGroup, nil))
+		}
+		switch {
+		case side == sideNone:
+			unresolved = append(unresolved, "group "+name)
+		case side == sideTheirs && !inTheirs:
+			groups = lo.Reject(groups, func(item Group, index int) bool { return item.Name == name })
+		case side == sideTheirs && inOurs:
+			replaceGroup(groups, theirsGroup)
+		case side == sideTheirs:
+			groups = append(groups, theirsGroup)
+		}
+	}
+	merged.Groups = groups
+
+	split, ok := mergeValue(base.Split, ours.Split, theirs.Split, func() mergeSide {
+		if resolve.split == nil {
+			return sideNone
+		}
+		return resolve.split(base.Split, ours.Split, theirs.Split)
+	})
+	merged.Split = split
+	if !ok {
+		unresolved = append(unresolved, "the split key")
+	}
+
+	return merged, unresolved
+}
+
+// replaceGroup replaces the group with the same name in groups
+func replaceGroup(groups []Group, group Group) {
+	for i := range groups {
+		if groups[i].Name == group.Name {
+			groups[i] = group
+		}
+	}
+}
+
+// describeKeyID names the user of an invited key for messages
+func describeKeyID(entryID string, keysFiles ...*KeysFile) string {
+	for _, keysFile := range keysFiles {
+		item, found := lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+			return encryptedKeyID(item) == entryID
+		})
+		if found && !item.IsRecovery {
+			return item.Username + " " + item.Fingerprint
+		}
+	}
+	return entryID
+}
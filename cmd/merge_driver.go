@@ -0,0 +1,507 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// mergeDriverCmd represents the merge-driver command
+var mergeDriverCmd = &cobra.Command{
+	Use:   "merge-driver BASE OURS THEIRS [PATH]",
+	Short: "Merge keys and secrets files for git",
+	Long: `Merge keys.json and secrets.json files for git, run by git as a merge driver after 'epicenv git install'.
+
+Values, invited keys and groups are merged one by one, so changes to different variables on two branches don't
+conflict. Values are decrypted to compare them, so a value that was only encrypted again is not a change. When
+both branches changed the same one differently, you are asked which to keep with the decrypted values if there is
+a terminal, otherwise ours is kept and the file is left conflicted for you to fix with epicenv.
+
+The merged result is written to OURS. PATH is where the file is in the repository, which is needed to decrypt
+values and to sign the merged file. Signatures can't be merged, so the merged file is signed again with your key
+if you have the role to change it: admin for keys.json, writer for secrets.json. Otherwise its signature is left
+conflicted, until someone with the role signs it with 'epicenv migrate'.
+
+Example:
+  git config merge.epicenv.driver "epicenv merge-driver %O %A %B %P"`,
+	Run:  runMergeDriver,
+	Args: cobra.RangeArgs(3, 4),
+}
+
+func init() {
+	rootCmd.AddCommand(mergeDriverCmd)
+}
+
+func runMergeDriver(cmd *cobra.Command, args []string) {
+	basePath, oursPath, theirsPath := args[0], args[1], args[2]
+	filePath := ""
+	if len(args) > 3 {
+		filePath = args[3]
+	}
+
+	files := make([][]byte, 3)
+	for i, sidePath := range []string{basePath, oursPath, theirsPath} {
+		fileBytes, err := os.ReadFile(sidePath)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error reading %s", sidePath)
+		}
+		files[i] = fileBytes
+	}
+
+	if strings.HasSuffix(filePath, ".sig") || bytes.HasPrefix(bytes.TrimSpace(files[1]), []byte("-----BEGIN "+sshSigPEMType)) {
+		signedPath := strings.TrimSuffix(filePath, ".sig")
+		sig, err := takeMergeSignature(signedPath)
+		if err == nil && sig == nil {
+			err = fmt.Errorf("it wasn't signed when it was merged")
+		}
+		if err != nil {
+			// Neither side's signature is valid for the merged file, so it can't be resolved with one of them
+			writeErr := os.WriteFile(oursPath, nil, 0777)
+			if writeErr != nil {
+				logger.Fatal().Err(writeErr).Msgf("error writing %s", oursPath)
+			}
+			logger.Fatal().Err(err).Msgf("Can't sign %s, someone with the role to change it must sign it with 'epicenv migrate' and 'git add' its signature", lo.Ternary(signedPath != "", signedPath, "the merged file"))
+		}
+
+		err = os.WriteFile(oursPath, sig, 0777)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error writing %s", oursPath)
+		}
+		logger.Info().Msgf("Signed the merged %s", signedPath)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(files[1], &fields); err != nil {
+		logger.Fatal().Err(err).Msgf("error parsing %s, is it a keys or secrets file?", lo.Ternary(filePath != "", filePath, oursPath))
+	}
+
+	prompt := openMergePrompt()
+	if prompt != nil {
+		defer prompt.Close()
+	}
+
+	// A signature left by an earlier merge that stopped is not for this one
+	if _, err := takeMergeSignature(filePath); err != nil {
+		logger.Warn().Err(err).Msg("error removing the signature of an earlier merge")
+	}
+
+	var merged any
+	var unresolved []string
+	var err error
+	_, isKeys := fields["EncryptedKeys"]
+	if isKeys {
+		merged, unresolved, err = mergeKeysDriver(files, prompt)
+	} else {
+		merged, unresolved, err = mergeSecretsDriver(files, filePath, prompt)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error merging")
+	}
+
+	fileBytes, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error in json.MarshalIndent")
+	}
+	err = os.WriteFile(oursPath, fileBytes, 0777)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error writing %s", oursPath)
+	}
+
+	if len(unresolved) > 0 {
+		logger.Fatal().Msgf("Kept ours for %s in %s, fix them with epicenv and 'git add' the file", strings.Join(unresolved, ", "), lo.Ternary(filePath != "", filePath, "the merged file"))
+	}
+
+	err = signMergedFile(filePath, fileBytes, files[1], isKeys)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("Can't sign %s, its signature will be left conflicted", lo.Ternary(filePath != "", filePath, "the merged file"))
+	}
+}
+
+// signMergedFile signs the merged fileBytes of filePath with one of our keys that can change it on our side, see
+// mergedFileSignature, and leaves the signature for the driver of its .sig file. ours is our side of the file.
+func signMergedFile(filePath string, fileBytes, ours []byte, isKeys bool) error {
+	if filePath == "" {
+		return fmt.Errorf("the path of the file is needed to sign it")
+	}
+
+	var keysFile *KeysFile
+	var err error
+	if isKeys {
+		keysFile, err = parseGitFile[KeysFile](ours)
+	} else {
+		env := envForFilePath(filePath)
+		if env == "" {
+			return fmt.Errorf("%s is not in a .epicenv directory", filePath)
+		}
+		var rootEnv string
+		rootEnv, err = resolveRootEnv(env)
+		if err == nil {
+			keysFile, err = readKeysFile(rootEnv)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the keys of %s: %w", filePath, err)
+	}
+
+	sig, err := mergedFileSignature(fileBytes, keysFile.EncryptedKeys, lo.Ternary(isKeys, roleAdmin, roleWriter))
+	if err != nil {
+		return err
+	}
+
+	sigPath, err := mergeSignaturePath(filePath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(sigPath), 0700)
+	if err != nil {
+		return fmt.Errorf("error in os.MkdirAll: %w", err)
+	}
+	err = os.WriteFile(sigPath, sig, 0600)
+	if err != nil {
+		return fmt.Errorf("error in os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// mergedFileSignature signs fileBytes with one of our keys that has the required role in keys
+func mergedFileSignature(fileBytes []byte, keys []EncryptedKey, required string) ([]byte, error) {
+	allowed := lo.Filter(keys, func(item EncryptedKey, index int) bool {
+		return !item.IsRecovery && hasRole(keyRole(item), required)
+	})
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: nobody is a %s", ErrInsufficientRole, required)
+	}
+
+	signer, err := loadSigner(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: only a %s can sign it: %w", ErrInsufficientRole, required, err)
+	}
+
+	return signSSHSig(signer, fileBytes)
+}
+
+// mergeSignaturePath is where the signature of the merged filePath is left for the driver of its .sig file, in the
+// git directory. Git runs merge drivers at the top of the repository.
+func mergeSignaturePath(filePath string) (string, error) {
+	hash := sha256.Sum256([]byte(filePath))
+	output, err := runGit(".", "rev-parse", "--git-path", path.Join("epicenv-merge", hex.EncodeToString(hash[:8])+".sig"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// mergeConflicted tells if git left filePath conflicted in a merge, like a signature the merge driver couldn't sign
+func mergeConflicted(filePath string) bool {
+	output, err := runGit(filepath.Dir(filePath), "ls-files", "--unmerged", "--", filepath.Base(filePath))
+	return err == nil && len(bytes.TrimSpace(output)) > 0
+}
+
+// takeMergeSignature returns and removes the signature left for the merged filePath, nil if there is none
+func takeMergeSignature(filePath string) ([]byte, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+
+	sigPath, err := mergeSignaturePath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := os.ReadFile(sigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	err = os.Remove(sigPath)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.Remove: %w", err)
+	}
+
+	return sig, nil
+}
+
+// parseGitFile parses a file given by git, which is empty if it doesn't exist on that side, e.g. the base of a file both sides added
+func parseGitFile[T any](fileBytes []byte) (*T, error) {
+	var parsed T
+	if len(bytes.TrimSpace(fileBytes)) == 0 {
+		return &parsed, nil
+	}
+	err := json.Unmarshal(fileBytes, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling, is it corrupted?: %w", err)
+	}
+	return &parsed, nil
+}
+
+// mergeSecretsDriver merges base, ours and theirs secrets files, decrypting values with our key for the environment of filePath
+func mergeSecretsDriver(files [][]byte, filePath string, prompt *mergePrompt) (*SecretsFile, []string, error) {
+	var sides []*SecretsFile
+	for _, fileBytes := range files {
+		secretsFile, err := parseGitFile[SecretsFile](fileBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		sides = append(sides, secretsFile)
+	}
+
+	keys := loadMergeKeys(filePath)
+
+	same := func(a, b EncryptedSecret) bool {
+		if reflect.DeepEqual(a, b) {
+			return true
+		}
+		aValue, _, aOk := keys.decrypt(a)
+		bValue, _, bOk := keys.decrypt(b)
+		return aOk && bOk && aValue == bValue && a.Personal == b.Personal && a.Group == b.Group && a.NeedsRotation == b.NeedsRotation
+	}
+
+	resolve := func(name string, base, ours, theirs *EncryptedSecret) mergeSide {
+		describe := func(item *EncryptedSecret) string {
+			if item == nil {
+				return "(removed)"
+			}
+			value, _, ok := keys.decrypt(*item)
+			if !ok {
+				return "(can't decrypt)"
+			}
+			return lo.Ternary(item.Group != "", fmt.Sprintf("%s (group %s)", value, item.Group), value)
+		}
+		return prompt.choose(fmt.Sprintf("Both sides changed %s", name), describe(base), describe(ours), describe(theirs))
+	}
+
+	merged, unresolved := mergeSecretsFiles(sides[0], sides[1], sides[2], same, resolve)
+
+	if keys == nil {
+		return merged, unresolved, nil
+	}
+
+	// One side may have rotated the key while the other set values with the old one
+	undecryptable := 0
+	for i, item := range merged.Secrets {
+		value, stale, ok := keys.decrypt(item)
+		if !ok {
+			undecryptable += lo.Ternary(item.Group == "", 1, 0)
+			continue
+		}
+		if !stale {
+			continue
+		}
+		if checkSecretBound(keys.keysFile, item) != nil {
+			// Encrypting it again would bind a value that was copied in from elsewhere, loading refuses it
+			continue
+		}
+
+		encrypted, err := encryptSecret(keys.symKey, keys.env, item.Name, item.Personal, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		encrypted.NeedsRotation = item.NeedsRotation
+		merged.Secrets[i] = encrypted
+	}
+	if undecryptable > 0 {
+		logger.Warn().Msgf("%d values can't be decrypted with your key, if the key was rotated on the other side set them again after merging", undecryptable)
+	}
+
+	return merged, unresolved, nil
+}
+
+// loadMergeKeys loads our keys for the environment of the secrets file at filePath, nil if we can't decrypt its values
+func loadMergeKeys(filePath string) *envKeyring {
+	env := envForFilePath(filePath)
+	if env == "" {
+		logger.Warn().Msg("No environment for the file, comparing encrypted values")
+		return nil
+	}
+
+	keys, err := loadEnvKeyring(env)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("Can't decrypt the values of %s, comparing encrypted values", env)
+		return nil
+	}
+
+	return keys
+}
+
+// mergeKeysDriver merges base, ours and theirs keys files
+func mergeKeysDriver(files [][]byte, prompt *mergePrompt) (*KeysFile, []string, error) {
+	var sides []*KeysFile
+	for _, fileBytes := range files {
+		keysFile, err := parseGitFile[KeysFile](fileBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		sides = append(sides, keysFile)
+	}
+	base, ours, theirs := sides[0], sides[1], sides[2]
+
+	describeKey := func(item *EncryptedKey) string {
+		if item == nil {
+			return "(removed)"
+		}
+		if item.IsRecovery {
+			return "recovery passphrase"
+		}
+		description := fmt.Sprintf("%s %s as %s", item.Username, item.Fingerprint, lo.Ternary(item.Role != "", item.Role, roleAdmin))
+		return description + formatExpiry(&KeysFile{EncryptedKeys: []EncryptedKey{*item}}, item.Username, time.Now())
+	}
+	describeGroup := func(item *Group) string {
+		if item == nil {
+			return "(removed)"
+		}
+		return "members " + strings.Join(groupMembers(item), ", ")
+	}
+	describeSplit := func(item *SplitKey) string {
+		if item == nil {
+			return "(not split)"
+		}
+		return fmt.Sprintf("any %d of %s", item.Threshold, strings.Join(lo.Uniq(lo.Map(item.Shares, func(share EncryptedKey, index int) string {
+			return share.Username
+		})), ", "))
+	}
+
+	merged, unresolved := mergeKeysFiles(base, ours, theirs, keysMergeResolver{
+		keys: func(entryID string, base, ours, theirs *EncryptedKey) mergeSide {
+			item, _ := lo.Find([]*EncryptedKey{ours, theirs, base}, func(item *EncryptedKey) bool { return item != nil })
+			question := lo.Ternary(item.IsRecovery, "Both sides changed the recovery passphrase", fmt.Sprintf("Both sides changed the key of %s %s", item.Username, item.Fingerprint))
+			return prompt.choose(question, describeKey(base), describeKey(ours), describeKey(theirs))
+		},
+		group: func(name string, base, ours, theirs *Group) mergeSide {
+			return prompt.choose(fmt.Sprintf("Both sides changed group %s", name), describeGroup(base), describeGroup(ours), describeGroup(theirs))
+		},
+		split: func(base, ours, theirs *SplitKey) mergeSide {
+			return prompt.choose("Both sides split the key", describeSplit(base), describeSplit(ours), describeSplit(theirs))
+		},
+	})
+
+	if ours.Generation == theirs.Generation {
+		return merged, unresolved, nil
+	}
+
+	// One side rotated the key, so whatever the other side added still has the old key
+	rotated := lo.Ternary(merged.Generation == ours.Generation, ours, theirs)
+	unresolved = append(unresolved, rewrapStaleKeys(merged, rotated)...)
+
+	return merged, unresolved, nil
+}
+
+// rewrapStaleKeys encrypts the symmetric key of rotated again for keys in merged that came from the side that didn't
+// rotate it. Recovery entries and split keys can't be, so they are removed. Returns what couldn't be re-encrypted.
+func rewrapStaleKeys(merged, rotated *KeysFile) []string {
+	isStale := func(item EncryptedKey) bool {
+		return !lo.ContainsBy(rotated.EncryptedKeys, func(rotatedItem EncryptedKey) bool {
+			return reflect.DeepEqual(item, rotatedItem)
+		})
+	}
+
+	if merged.Split != nil && !reflect.DeepEqual(merged.Split, rotated.Split) {
+		logger.Warn().Msg("Removed the split key, as the key was rotated on the other side. Split it again with 'epicenv recovery split'")
+		merged.Split = nil
+	}
+
+	var symKey []byte
+	var unresolved []string
+	kept := merged.EncryptedKeys[:0]
+	for _, item := range merged.EncryptedKeys {
+		if !isStale(item) {
+			kept = append(kept, item)
+			continue
+		}
+
+		if item.IsRecovery {
+			logger.Warn().Msg("Removed the recovery passphrase, as the key was rotated on the other side. Enable it again with 'epicenv recovery enable'")
+			continue
+		}
+
+		if symKey == nil {
+			var err error
+			symKey, err = unwrapWithLocalKeys(rotated.EncryptedKeys)
+			if err != nil {
+				logger.Warn().Err(err).Msg("Can't decrypt the rotated key to give it to keys from the other side")
+				symKey = []byte{}
+			}
+		}
+		if len(symKey) == 0 {
+			unresolved = append(unresolved, fmt.Sprintf("key %s %s, invite them again", item.Username, item.Fingerprint))
+			kept = append(kept, item)
+			continue
+		}
+
+		encSymKey, algorithm, err := encryptWithPublicKey(symKey, item.PublicKey)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Can't encrypt the rotated key for %s", item.Username)
+			unresolved = append(unresolved, fmt.Sprintf("key %s %s, invite them again", item.Username, item.Fingerprint))
+			kept = append(kept, item)
+			continue
+		}
+		item.EncryptedSharedKey, item.Algorithm = encSymKey, algorithm
+		kept = append(kept, item)
+		logger.Info().Msgf("Gave the rotated key to %s %s", item.Username, item.Fingerprint)
+	}
+	merged.EncryptedKeys = kept
+
+	return unresolved
+}
+
+// mergePrompt asks how to resolve conflicts on the terminal, git doesn't give merge drivers its stdin
+type mergePrompt struct {
+	tty    *os.File
+	reader *bufio.Reader
+}
+
+// openMergePrompt opens the terminal, nil if there is none
+func openMergePrompt() *mergePrompt {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		logger.Debug().Err(err).Msg("No terminal to ask about conflicts")
+		return nil
+	}
+	return &mergePrompt{tty: tty, reader: bufio.NewReader(tty)}
+}
+
+func (p *mergePrompt) Close() {
+	p.tty.Close()
+}
+
+// choose shows the conflict and asks which side to keep, sideNone if there is no terminal or they don't choose
+func (p *mergePrompt) choose(question, base, ours, theirs string) mergeSide {
+	if p == nil {
+		return sideNone
+	}
+
+	fmt.Fprintf(p.tty, "%s:\n  base:   %s\n  ours:   %s\n  theirs: %s\n", question, base, ours, theirs)
+	for {
+		fmt.Fprint(p.tty, "Keep [o]urs, [t]heirs, or leave it [c]onflicted? ")
+		answer, err := p.reader.ReadString('\n')
+		if err != nil {
+			return sideNone
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "o", "ours":
+			return sideOurs
+		case "t", "theirs":
+			return sideTheirs
+		case "c", "conflicted":
+			return sideNone
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeSecretsFiles(t *testing.T) {
+	secrets := func(items ...EncryptedSecret) *SecretsFile {
+		return &SecretsFile{Secrets: items}
+	}
+	// Values are "plaintext@nonce", so encrypting again changes the encrypted value but not the plaintext
+	same := func(a, b EncryptedSecret) bool {
+		return strings.Split(a.Value, "@")[0] == strings.Split(b.Value, "@")[0] && a.Group == b.Group
+	}
+
+	base := secrets(
+		EncryptedSecret{Name: "KEEP", Value: "keep@0"},
+		EncryptedSecret{Name: "OURS", Value: "a@0"},
+		EncryptedSecret{Name: "THEIRS", Value: "b@0"},
+		EncryptedSecret{Name: "REMOVED", Value: "c@0"},
+		EncryptedSecret{Name: "BOTH", Value: "d@0"},
+		EncryptedSecret{Name: "CONFLICT", Value: "e@0"},
+	)
+	ours := secrets(
+		EncryptedSecret{Name: "KEEP", Value: "keep@1"},
+		EncryptedSecret{Name: "OURS", Value: "a2@1"},
+		EncryptedSecret{Name: "THEIRS", Value: "b@1"},
+		EncryptedSecret{Name: "REMOVED", Value: "c@1"},
+		EncryptedSecret{Name: "BOTH", Value: "d2@1"},
+		EncryptedSecret{Name: "CONFLICT", Value: "e2@1"},
+		EncryptedSecret{Name: "ADDED_OURS", Value: "f@1"},
+	)
+	theirs := secrets(
+		EncryptedSecret{Name: "KEEP", Value: "keep@0"},
+		EncryptedSecret{Name: "ADDED_THEIRS", Value: "g@2"},
+		EncryptedSecret{Name: "OURS", Value: "a@0"},
+		EncryptedSecret{Name: "THEIRS", Value: "b2@2"},
+		EncryptedSecret{Name: "BOTH", Value: "d2@2"},
+		EncryptedSecret{Name: "CONFLICT", Value: "e3@2"},
+	)
+
+	merged, unresolved := mergeSecretsFiles(base, ours, theirs, same, nil)
+
+	want := secrets(
+		EncryptedSecret{Name: "ADDED_OURS", Value: "f@1"},
+		EncryptedSecret{Name: "ADDED_THEIRS", Value: "g@2"},
+		EncryptedSecret{Name: "BOTH", Value: "d2@1"},
+		EncryptedSecret{Name: "CONFLICT", Value: "e2@1"},
+		EncryptedSecret{Name: "KEEP", Value: "keep@1"},
+		EncryptedSecret{Name: "OURS", Value: "a2@1"},
+		EncryptedSecret{Name: "THEIRS", Value: "b2@2"},
+	)
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeSecretsFiles() = %+v, want %+v", merged.Secrets, want.Secrets)
+	}
+	if !reflect.DeepEqual(unresolved, []string{"CONFLICT"}) {
+		t.Errorf("unresolved = %v, want [CONFLICT]", unresolved)
+	}
+
+	// Resolving with theirs takes their value, even if it is a removal
+	theirs.Secrets = theirs.Secrets[:len(theirs.Secrets)-1]
+	merged, unresolved = mergeSecretsFiles(base, ours, theirs, same, func(name string, base, ours, theirs *EncryptedSecret) mergeSide {
+		if name != "CONFLICT" || base == nil || ours == nil || theirs != nil {
+			t.Errorf("resolve(%s, %v, %v, %v) was not the conflict", name, base, ours, theirs)
+		}
+		return sideTheirs
+	})
+	if len(unresolved) != 0 {
+		t.Errorf("unresolved = %v, want none", unresolved)
+	}
+	for _, item := range merged.Secrets {
+		if item.Name == "CONFLICT" {
+			t.Errorf("CONFLICT was kept, want it removed")
+		}
+	}
+}
+
+func TestMergeKeysFiles(t *testing.T) {
+	key := func(username, publicKey, wrapped string) EncryptedKey {
+		return EncryptedKey{Username: username, PublicKey: publicKey, EncryptedSharedKey: wrapped}
+	}
+
+	base := &KeysFile{
+		Version:       1,
+		EncryptedKeys: []EncryptedKey{key("me", "pk-me", "k0"), key("bob", "pk-bob", "k0")},
+		Groups:        []Group{{Name: "ops", EncryptedKeys: []EncryptedKey{key("me", "pk-me", "g")}}},
+	}
+	// Ours invited alice and added bob to ops
+	ours := &KeysFile{
+		Version:       1,
+		EncryptedKeys: []EncryptedKey{key("me", "pk-me", "k0"), key("bob", "pk-bob", "k0"), key("alice", "pk-alice", "k0")},
+		Groups:        []Group{{Name: "ops", EncryptedKeys: []EncryptedKey{key("me", "pk-me", "g"), key("bob", "pk-bob", "g")}}},
+	}
+	// Theirs uninvited bob, rotated the key, and added carol to ops
+	theirs := &KeysFile{
+		Version:       1,
+		EncryptedKeys: []EncryptedKey{key("me", "pk-me", "k1")},
+		Generation:    1,
+		PreviousKeys:  []PreviousKey{{Generation: 0, EncryptedKey: "k0"}},
+		Groups:        []Group{{Name: "ops", EncryptedKeys: []EncryptedKey{key("me", "pk-me", "g"), key("carol", "pk-carol", "g")}}},
+	}
+
+	merged, unresolved := mergeKeysFiles(base, ours, theirs, keysMergeResolver{})
+
+	want := &KeysFile{
+		Version:       1,
+		EncryptedKeys: []EncryptedKey{key("me", "pk-me", "k1"), key("alice", "pk-alice", "k0")},
+		Generation:    1,
+		PreviousKeys:  []PreviousKey{{Generation: 0, EncryptedKey: "k0"}},
+		Groups: []Group{{Name: "ops", EncryptedKeys: []EncryptedKey{
+			key("me", "pk-me", "g"), key("bob", "pk-bob", "g"), key("carol", "pk-carol", "g"),
+		}}},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeKeysFiles() = %+v, want %+v", merged, want)
+	}
+	if len(unresolved) != 0 {
+		t.Errorf("unresolved = %v, want none", unresolved)
+	}
+
+	// Both sides rotating the key can't be merged
+	ours.Generation = 1
+	ours.PreviousKeys = []PreviousKey{{Generation: 0, EncryptedKey: "other"}}
+	_, unresolved = mergeKeysFiles(base, ours, theirs, keysMergeResolver{})
+	if !reflect.DeepEqual(unresolved, []string{"the key, both sides rotated it"}) {
+		t.Errorf("unresolved = %v, want the key", unresolved)
+	}
+}
+
+func TestMergedFileSignature(t *testing.T) {
+	publicKey, privateKey, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_PRIVATE_KEY", string(privateKey))
+	keys := []EncryptedKey{{Username: "alice", PublicKey: publicKey, Role: roleWriter}}
+	fileBytes := []byte(`{"Secrets":[]}`)
+
+	sig, err := mergedFileSignature(fileBytes, keys, roleWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer, err := verifySSHSig(sig, fileBytes); err != nil || !samePublicKey(authorizedKeyString(signer), publicKey) {
+		t.Errorf("verifySSHSig() = %v, %v, want signed by alice", signer, err)
+	}
+
+	// Writers can't sign a merged keys.json
+	if _, err := mergedFileSignature(fileBytes, keys, roleAdmin); !errors.Is(err, ErrInsufficientRole) {
+		t.Errorf("signing as a writer for admins: err = %v, want ErrInsufficientRole", err)
+	}
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the environment to the latest file formats",
+	Long: `Upgrade the environment to the latest file formats.
+
+Keys that were encrypted with legacy RSA PKCS#1 v1.5 padding are re-encrypted with RSA-OAEP (SHA-256),
+and values that were encrypted before they were bound to their environment and name are re-encrypted
+in the root environment and all of its overlays, including your personal secrets. Keys that were invited
+before fingerprints were stored are pinned to their current fingerprint.
+
+Any keys or secrets files that are not signed yet are signed with your key. Migrating is refused if
+a file has an invalid signature, or its signature was removed after it was signed, as it may have been
+tampered with. A keys.json whose signature was removed is only signed again if nobody was invited,
+uninvited or changed role since the last signed version. A secrets.json whose signature the merge driver
+left conflicted is signed again, check its values before you 'git add' the signature.
+
+Once every value is bound, keys.json records it, and values that are not bound are refused from then on,
+as they can only have been copied in from another variable.
+
+You must be an admin of the environment to migrate it.
+
+Example:
+  epicenv migrate -e prod`,
+	Run: runMigrate,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Migrating keys of root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	// Roles come from the last keys.json we trusted, a removed signature can only be restored if no roles changed
+	trustedKeysFile, err := verifyKeysFile(rootEnv)
+	if trustedKeysFile == nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+	switch {
+	case err == nil || errors.Is(err, ErrUnsigned):
+	case errors.Is(err, ErrSignatureRemoved):
+		if changes := roleChanges(trustedKeysFile, keysFile); len(changes) > 0 {
+			logger.Fatal().Msgf("Refusing to sign %s, its roles differ from the last signed version: %s", keysFilePath(rootEnv), strings.Join(changes, ", "))
+		}
+	default:
+		logger.Fatal().Err(err).Msgf("Refusing to migrate, the signature check failed for %s", keysFilePath(rootEnv))
+	}
+
+	ourRole, err := localRole(trustedKeysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding your role")
+	}
+	if !hasRole(ourRole, roleAdmin) {
+		logger.Fatal().Msgf("You are a %s in %s, this needs the %s role", ourRole, rootEnv, roleAdmin)
+	}
+
+	environments, err := getEnvironmentsForRoot(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding overlays")
+	}
+
+	// Don't bless tampered files with a fresh signature
+	trusted, err := readTrustedKeys(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading the trusted keys")
+	}
+	filePaths := []string{keysFilePath(rootEnv)}
+	for _, overlayEnv := range environments {
+		if _, err := os.Stat(secretsFilePath(overlayEnv, false)); err != nil {
+			continue
+		}
+		_, err = verifySecretsSignature(overlayEnv, trustedKeysFile.EncryptedKeys, trusted)
+		if errors.Is(err, ErrSignatureRemoved) && mergeConflicted(secretsFilePath(overlayEnv, false)+".sig") {
+			logger.Warn().Msgf("Signing the merged %s, check its values before you 'git add' its signature", secretsFilePath(overlayEnv, false))
+			err = nil
+		}
+		if err != nil && !errors.Is(err, ErrUnsigned) {
+			logger.Fatal().Err(err).Msgf("Refusing to migrate, the signature check failed for %s", secretsFilePath(overlayEnv, false))
+		}
+		filePaths = append(filePaths, secretsFilePath(overlayEnv, false))
+	}
+
+	migrated := 0
+	failed := 0
+	for i, item := range keysFile.EncryptedKeys {
+		if item.Algorithm != "" && item.Algorithm != algorithmRSAPKCS1v15 {
+			continue
+		}
+
+		encSymKey, algorithm, err := encryptWithPublicKey(symKey, item.PublicKey)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Could not migrate a key for %s, leaving it as is", item.Username)
+			failed++
+			continue
+		}
+
+		keysFile.EncryptedKeys[i].EncryptedSharedKey = encSymKey
+		keysFile.EncryptedKeys[i].Algorithm = algorithm
+		migrated++
+	}
+
+	// Pin keys that were invited before fingerprints were stored
+	fingerprinted := 0
+	for i, item := range keysFile.EncryptedKeys {
+		if item.Fingerprint != "" || item.IsRecovery {
+			continue
+		}
+
+		fingerprint, err := keyFingerprint(item.PublicKey)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("Could not fingerprint a key for %s, leaving it as is", item.Username)
+			continue
+		}
+		keysFile.EncryptedKeys[i].Fingerprint = fingerprint
+		fingerprinted++
+	}
+
+	upgradeVersion := failed == 0 && keysFile.Version < currentKeysFileVersion
+	if upgradeVersion {
+		keysFile.Version = currentKeysFileVersion
+	}
+
+	if migrated > 0 || fingerprinted > 0 || upgradeVersion {
+		err = writeKeysFile(rootEnv, *keysFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error writing keys file")
+		}
+	}
+
+	logger.Info().Msgf("Migrated %d keys and fingerprinted %d keys in %s", migrated, fingerprinted, rootEnv)
+
+	upgraded := 0
+	for _, overlayEnv := range environments {
+		for _, personal := range []bool{false, true} {
+			count, err := upgradeSecretsFile(overlayEnv, personal, symKey, keysFile)
+			if err != nil {
+				logger.Fatal().Err(err).Msgf("error migrating secrets for %s", overlayEnv)
+			}
+			upgraded += count
+		}
+	}
+
+	logger.Info().Msgf("Migrated %d values across %d environments", upgraded, len(environments))
+
+	// From now on, values that aren't bound can only have been copied in from elsewhere
+	if keysFile.SecretsVersion < currentSecretVersion {
+		keysFile.SecretsVersion = currentSecretVersion
+		err = writeKeysFile(rootEnv, *keysFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error writing keys file")
+		}
+		logger.Info().Msgf("Values in %s that are not bound to their names are refused from now on", rootEnv)
+	}
+
+	signed := 0
+	for _, filePath := range filePaths {
+		_, err = verifyFileSignature(filePath, keysFile.EncryptedKeys)
+		if !errors.Is(err, ErrUnsigned) {
+			continue
+		}
+
+		err = signFile(filePath, keysFile.EncryptedKeys)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error signing %s", filePath)
+		}
+		signed++
+	}
+
+	logger.Info().Msgf("Signed %d files", signed)
+}
+
+// upgradeSecretsFile re-encrypts legacy values so they are bound to their environment and name, unless keysFile
+// says every value was bound already. Returns the number of upgraded values.
+func upgradeSecretsFile(env string, personal bool, symKey []byte, keysFile *KeysFile) (int, error) {
+	if _, err := os.Stat(secretsFilePath(env, personal)); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	secretsFile, err := readSecretsFile(env, personal)
+	if err != nil {
+		return 0, fmt.Errorf("error reading secrets file: %w", err)
+	}
+
+	if personal {
+		err = migratePersonalSecrets(env, secretsFile, symKey)
+		if err != nil {
+			return 0, fmt.Errorf("error migrating personal secrets to the current key: %w", err)
+		}
+	}
+
+	upgraded := 0
+	for i, item := range secretsFile.Secrets {
+		if item.Version == currentSecretVersion || (!personal && item.Personal) {
+			// Already bound, or a placeholder for a personal value
+			continue
+		}
+		if err := checkSecretBound(keysFile, item); err != nil {
+			return 0, err
+		}
+
+		decrypted, err := decryptSecret(symKey, env, item)
+		if err != nil {
+			return 0, fmt.Errorf("error decrypting %s: %w", item.Name, err)
+		}
+		secretsFile.Secrets[i], err = encryptSecret(symKey, env, item.Name, item.Personal, decrypted)
+		if err != nil {
+			return 0, fmt.Errorf("error encrypting %s: %w", item.Name, err)
+		}
+		secretsFile.Secrets[i].NeedsRotation = item.NeedsRotation
+		upgraded++
+	}
+
+	if upgraded == 0 {
+		return 0, nil
+	}
+
+	err = writeSecretsFile(env, *secretsFile, personal)
+	if err != nil {
+		return 0, fmt.Errorf("error writing secrets file: %w", err)
+	}
+
+	return upgraded, nil
+}
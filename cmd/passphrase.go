@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// maxPassphraseAttempts is how many times we will ask for a passphrase before giving up on a key
+const maxPassphraseAttempts = 3
+
+// passphrases that have worked before, so one passphrase shared by several keys is only asked for once
+var passphrases [][]byte
+
+// parseEncryptedPrivateKey decrypts a passphrase protected private key.
+// Known passphrases are tried first, then EPICENV_SSH_PASSPHRASE, then EPICENV_ASKPASS, then a hidden prompt
+// if we have a terminal, then SSH_ASKPASS.
+func parseEncryptedPrivateKey(privateKeyBytes []byte, privateKeyPath string) (interface{}, error) {
+	for _, passphrase := range passphrases {
+		privateKey, err := ssh.ParseRawPrivateKeyWithPassphrase(privateKeyBytes, passphrase)
+		if err == nil {
+			return privateKey, nil
+		}
+	}
+
+	prompt := fmt.Sprintf("Enter passphrase for %s: ", privateKeyPath)
+	for attempt := 0; attempt < maxPassphraseAttempts; attempt++ {
+		passphrase, interactive, err := readPassphrase(prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		privateKey, err := ssh.ParseRawPrivateKeyWithPassphrase(privateKeyBytes, passphrase)
+		if err == nil {
+			passphrases = append(passphrases, passphrase)
+			return privateKey, nil
+		}
+
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, err
+		}
+
+		if !interactive {
+			// Asking again would give the same answer
+			return nil, fmt.Errorf("incorrect passphrase for %s", privateKeyPath)
+		}
+
+		logger.Warn().Msgf("Incorrect passphrase for %s", privateKeyPath)
+	}
+
+	return nil, fmt.Errorf("too many incorrect passphrases for %s", privateKeyPath)
+}
+
+// readPassphrase gets a passphrase from the first available source, and whether a person was asked for it
+func readPassphrase(prompt string) ([]byte, bool, error) {
+	if passphrase := os.Getenv("EPICENV_SSH_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), false, nil
+	}
+
+	if askpass := os.Getenv("EPICENV_ASKPASS"); askpass != "" {
+		passphrase, err := runAskpass(askpass, prompt)
+		return passphrase, true, err
+	}
+
+	// IDE might complain, but the cast is necessary for some OSs, because Stdin is a var instead of an untyped const
+	if term.IsTerminal(int(syscall.Stdin)) {
+		return []byte(readStdinHidden(prompt)), true, nil
+	}
+
+	if askpass := os.Getenv("SSH_ASKPASS"); askpass != "" {
+		passphrase, err := runAskpass(askpass, prompt)
+		return passphrase, true, err
+	}
+
+	return nil, false, fmt.Errorf("private key is passphrase protected, but there is no terminal to ask on. Set EPICENV_SSH_PASSPHRASE or EPICENV_ASKPASS")
+}
+
+// runAskpass runs an ssh-askpass style program, which prints the passphrase to stdout
+func runAskpass(askpass, prompt string) ([]byte, error) {
+	output, err := exec.Command(askpass, prompt).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running askpass program %s: %w", askpass, err)
+	}
+
+	return []byte(strings.TrimRight(string(output), "\r\n")), nil
+}
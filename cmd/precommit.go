@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// minLeakLength is the shortest value precommit looks for, shorter values like "true" or "8080" are everywhere
+const minLeakLength = 8
+
+// precommitCmd represents the precommit command
+var precommitCmd = &cobra.Command{
+	Use:   "precommit",
+	Short: "Refuse commits that would leak personal or decrypted values",
+	Long: `Check the files staged for commit, and fail if any of them is a personal_secrets.json or a temp-* activation
+script from the .epicenv directory, or contains a value of a variable we can decrypt, including personal values.
+Values shorter than 8 characters are not looked for.
+
+This is run by the pre-commit hook from 'epicenv git install-hooks'. To commit anyway, unstage the file or use
+git commit --no-verify.`,
+	Run:  runPrecommit,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(precommitCmd)
+}
+
+// stagedSecret is a decrypted value that must not be committed
+type stagedSecret struct {
+	Env   string
+	Name  string
+	Value string
+}
+
+func runPrecommit(cmd *cobra.Command, args []string) {
+	epicEnvPath := getEpicEnvPath()
+
+	// Names are relative to the top of the repository
+	output, err := runGit(epicEnvPath, "diff", "--cached", "--name-only", "-z", "--diff-filter=ACMR")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error listing staged files, is the .epicenv directory in a git repository?")
+	}
+	staged := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	if len(output) == 0 {
+		return
+	}
+
+	secrets := precommitSecrets()
+
+	var problems []string
+	for _, name := range staged {
+		if reason := forbiddenStagedFile(name); reason != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, reason))
+			continue
+		}
+
+		content, err := runGit(epicEnvPath, "show", ":"+name)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error reading staged %s", name)
+		}
+		for _, secret := range findLeakedSecrets(content, secrets) {
+			problems = append(problems, fmt.Sprintf("%s: contains the value of %s in %s", name, secret.Name, secret.Env))
+		}
+	}
+
+	if len(problems) > 0 {
+		logger.Fatal().Msgf("Refusing to commit:\n  %s\nUnstage them with git restore --staged, or commit with --no-verify if you are sure", strings.Join(problems, "\n  "))
+	}
+
+	logger.Debug().Msgf("Checked %d staged files against %d values", len(staged), len(secrets))
+}
+
+// forbiddenStagedFile returns why the file at name (relative to the top of the repository) must never be
+// committed, empty if it can be
+func forbiddenStagedFile(name string) string {
+	base := path.Base(name)
+	inEpicEnv := path.Base(path.Dir(path.Dir(name))) == ".epicenv"
+	switch {
+	case base == "personal_secrets.json":
+		return "personal values are never committed"
+	case inEpicEnv && strings.HasPrefix(base, "temp-"):
+		return "activation scripts contain decrypted values"
+	}
+	return ""
+}
+
+// precommitSecrets decrypts the shared and personal values of every environment we can, skipping the rest
+func precommitSecrets() []stagedSecret {
+	envs, err := listEnvironments()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error listing environments")
+	}
+
+	var secrets []stagedSecret
+	for _, env := range envs {
+		keys, err := loadEnvKeyring(env)
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Can't decrypt %s, not checking its values", env)
+			continue
+		}
+
+		for _, personal := range []bool{false, true} {
+			// Reading a personal secrets file that doesn't exist would create it
+			if _, err := os.Stat(secretsFilePath(env, personal)); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			secretsFile, err := readSecretsFile(env, personal)
+			if err != nil {
+				logger.Fatal().Err(err).Msgf("error reading secrets file of %s", env)
+			}
+
+			for _, item := range secretsFile.Secrets {
+				if value, _, ok := keys.decrypt(item); ok {
+					secrets = append(secrets, stagedSecret{Env: env, Name: item.Name, Value: value})
+				}
+			}
+		}
+	}
+
+	return secrets
+}
+
+// findLeakedSecrets returns the secrets whose values are in content, ignoring values shorter than minLeakLength
+func findLeakedSecrets(content []byte, secrets []stagedSecret) []stagedSecret {
+	var leaked []stagedSecret
+	for _, secret := range secrets {
+		if len(secret.Value) < minLeakLength || !bytes.Contains(content, []byte(secret.Value)) {
+			continue
+		}
+		if slices.ContainsFunc(leaked, func(other stagedSecret) bool {
+			return other.Env == secret.Env && other.Name == secret.Name
+		}) {
+			continue
+		}
+		leaked = append(leaked, secret)
+	}
+	return leaked
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestForbiddenStagedFile(t *testing.T) {
+	tests := map[string]bool{
+		".epicenv/local/personal_secrets.json":     true,
+		"app/.epicenv/prod/personal_secrets.json":  true,
+		".epicenv/local/temp-1700000000000":        true,
+		".epicenv/local/secrets.json":              false,
+		".epicenv/local/keys.json.sig":             false,
+		"scripts/temp-cleanup.sh":                  false,
+		"app/.epicenv/local/activate":              false,
+		".epicenv/local/personal_secrets.json.bak": false,
+	}
+
+	for name, forbidden := range tests {
+		if got := forbiddenStagedFile(name) != ""; got != forbidden {
+			t.Errorf("forbiddenStagedFile(%q) forbidden = %v, want %v", name, got, forbidden)
+		}
+	}
+}
+
+func TestFindLeakedSecrets(t *testing.T) {
+	secrets := []stagedSecret{
+		{Env: "local", Name: "API_TOKEN", Value: "supersecretvalue"},
+		{Env: "prod", Name: "API_TOKEN", Value: "supersecretvalue"},
+		{Env: "local", Name: "PORT", Value: "8080"},
+		{Env: "local", Name: "DB_PASS", Value: "not-in-there"},
+	}
+
+	content := []byte("token: supersecretvalue\nport: 8080\ntoken again: supersecretvalue\n")
+	want := []stagedSecret{secrets[0], secrets[1]}
+	if got := findLeakedSecrets(content, secrets); !reflect.DeepEqual(got, want) {
+		t.Errorf("findLeakedSecrets() = %+v, want %+v", got, want)
+	}
+
+	if got := findLeakedSecrets([]byte("nothing here"), secrets); len(got) != 0 {
+		t.Errorf("findLeakedSecrets() = %+v, want none", got)
+	}
+}
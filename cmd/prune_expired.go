@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// pruneExpiredCmd represents the prune-expired command
+var pruneExpiredCmd = &cobra.Command{
+	Use:   "prune-expired",
+	Short: "Uninvite users and headless keys whose invites expired",
+	Long: `Uninvite every user and headless key whose invite expired, see 'epicenv invite --expires'.
+
+They could have kept the key while they were invited, so the shared values they could read are marked as
+needing rotation, which loading the environment warns about until they are set again. Use --rotate to also
+rotate the key like 'epicenv rotate-key'. This is not a replacement for rotating secrets!
+
+Examples:
+  epicenv prune-expired -e prod
+  epicenv prune-expired -e prod --rotate`,
+	Run:  runPruneExpired,
+	Args: cobra.NoArgs,
+}
+
+var pruneExpiredRotateFlag bool
+
+func init() {
+	rootCmd.AddCommand(pruneExpiredCmd)
+	pruneExpiredCmd.Flags().BoolVar(&pruneExpiredRotateFlag, "rotate", false, "Also rotate the symmetric key")
+}
+
+func runPruneExpired(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Invites belong to root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	expired := expiredUsers(keysFile, time.Now())
+	if len(expired) == 0 {
+		logger.Info().Msgf("No invites to '%s' have expired", rootEnv)
+		return
+	}
+
+	// Load the symmetric key (so we know that we are invited to the env)
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	if !hasAdminWithout(keysFile, expired) {
+		logger.Fatal().Msgf("Refusing to uninvite %s, nobody would be an admin, extend an admin's invite with 'epicenv invite USER --expires never'", strings.Join(expired, ", "))
+	}
+
+	// Values in their groups need changing too
+	groups := lo.FilterMap(keysFile.Groups, func(group Group, index int) (string, bool) {
+		return group.Name, lo.Some(groupMembers(&group), expired)
+	})
+
+	removeUsers(keysFile, expired)
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	logger.Info().Msgf("Uninvited %s", strings.Join(expired, ", "))
+	if !pruneExpiredRotateFlag {
+		logger.Warn().Msg("**THIS IS NOT A REPLACEMENT FOR ROTATING SECRETS!** Run 'epicenv rotate-key', or prune with --rotate")
+	}
+
+	markUninvitedValues(rootEnv, expired, groups, symKey, pruneExpiredRotateFlag)
+}
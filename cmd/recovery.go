@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// algorithmScrypt encrypts the symmetric key with AES-GCM, using a key derived from a passphrase with scrypt
+	algorithmScrypt = "scrypt-aes256gcm"
+
+	// recoveryUsername can't be a username on any of the key sources
+	recoveryUsername = "(recovery)"
+
+	minRecoveryPassphraseLength = 20
+)
+
+// recoveryAdditionalData binds the encrypted symmetric key to being a recovery key
+var recoveryAdditionalData = []byte("epicenv recovery key v1")
+
+// defaultKDFParams takes around a second and 128MB of memory to derive a key
+var defaultKDFParams = KDFParams{N: 1 << 17, R: 8, P: 1}
+
+var ErrWrongRecoveryPassphrase = errors.New("wrong recovery passphrase")
+
+// recoveryCmd represents the recovery command
+var recoveryCmd = &cobra.Command{
+	Use:   "recovery",
+	Short: "Recover the environment with a passphrase if every invited key is lost",
+	Long: `Recover the environment with a passphrase if every invited key is lost.
+
+When recovery is enabled, the symmetric key is also encrypted with a key derived from a long passphrase.
+Keep the passphrase somewhere safe outside the repository, like a password manager or a safe, since anyone
+with it and the repository can decrypt every shared value. Use it with 'epicenv recovery unlock' to invite
+someone again.
+
+So that no single passphrase can recover the key, split it among admins instead, any --threshold of whom
+can recover it together with 'epicenv recovery combine'.
+
+Rotating the key disables recovery, since the new key can't be encrypted without the passphrase, and removes
+the shares of a split key.
+
+Set EPICENV_RECOVERY_PASSPHRASE to use a passphrase without being asked for it.
+
+Examples:
+  epicenv recovery enable              # Enable recovery with a passphrase you choose
+  epicenv recovery enable --generate   # Enable recovery with a generated passphrase
+  epicenv recovery unlock alice        # Invite alice's current keys with the passphrase
+  epicenv recovery split --threshold 3 --shares 5 alice bob carol dave erin
+  epicenv recovery share               # Print your share, run by each of 3 of them
+  epicenv recovery combine alice       # Invite alice's current keys with the 3 shares
+  epicenv recovery disable             # Remove the passphrase and the shares`,
+}
+
+var recoveryEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Enable recovery with a passphrase, replacing any previous one",
+	Run:   runRecoveryEnable,
+	Args:  cobra.NoArgs,
+}
+
+var recoveryDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Disable recovery with the passphrase and the split key",
+	Run:   runRecoveryDisable,
+	Args:  cobra.NoArgs,
+}
+
+var recoveryUnlockCmd = &cobra.Command{
+	Use:   "unlock USER",
+	Short: "Invite a user with the recovery passphrase, without needing an invited key",
+	Long: `Invite a user with the recovery passphrase, without needing an invited key.
+
+Their current keys are invited, keeping the role they have if they are already invited. Run it as the user
+being invited, so keys.json is signed by one of their keys.
+
+Examples:
+  epicenv recovery unlock alice
+  epicenv recovery unlock laptop --path ~/.ssh/id_ed25519.pub`,
+	Run:  runRecoveryUnlock,
+	Args: cobra.ExactArgs(1),
+}
+
+var (
+	recoveryGenerateFlag bool
+	recoveryPathFlag     string
+	recoveryRoleFlag     string
+)
+
+func init() {
+	rootCmd.AddCommand(recoveryCmd)
+	recoveryCmd.AddCommand(recoveryEnableCmd)
+	recoveryCmd.AddCommand(recoveryDisableCmd)
+	recoveryCmd.AddCommand(recoveryUnlockCmd)
+
+	recoveryEnableCmd.Flags().BoolVar(&recoveryGenerateFlag, "generate", false, "Generate a passphrase and print it to stdout")
+	recoveryUnlockCmd.Flags().StringVar(&recoveryPathFlag, "path", "", "Path to a public key file to invite as a headless key")
+	recoveryUnlockCmd.Flags().StringVar(&recoveryRoleFlag, "role", roleAdmin, "Role of the invitee if they are not invited yet")
+}
+
+func runRecoveryEnable(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Enabling recovery for root environment '%s' (overlays share its key)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	var passphrase string
+	if recoveryGenerateFlag {
+		passphrase = generateRecoveryPassphrase()
+	} else {
+		passphrase, err = readRecoveryPassphrase(true)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error reading recovery passphrase")
+		}
+	}
+	if len(passphrase) < minRecoveryPassphraseLength {
+		logger.Fatal().Msgf("The recovery passphrase must be at least %d characters, or use --generate", minRecoveryPassphraseLength)
+	}
+
+	recoveryKey, err := newRecoveryKey(symKey, passphrase, defaultKDFParams)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error encrypting with the recovery passphrase")
+	}
+
+	_, replaced := findRecoveryKey(keysFile)
+	removeUsers(keysFile, []string{recoveryUsername})
+	keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, recoveryKey)
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	if recoveryGenerateFlag {
+		fmt.Println(passphrase)
+	}
+	if replaced {
+		logger.Info().Msgf("Replaced the recovery passphrase for %s", rootEnv)
+	} else {
+		logger.Info().Msgf("Enabled recovery for %s", rootEnv)
+	}
+	logger.Warn().Msg("Anyone with the passphrase and the repository can decrypt every shared value, keep it somewhere safe!")
+}
+
+func runRecoveryDisable(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	if _, found := findRecoveryKey(keysFile); !found && keysFile.Split == nil {
+		logger.Info().Msgf("Recovery is not enabled for %s", rootEnv)
+		return
+	}
+
+	// Make sure that we are invited to the env
+	_, err = loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	removeUsers(keysFile, []string{recoveryUsername})
+	keysFile.Split = nil
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	logger.Info().Msgf("Disabled recovery for %s **ANYONE WHO HAD THE PASSPHRASE OR SHARES CAN STILL USE THE OLD KEY, ROTATE IT!**", rootEnv)
+}
+
+func runRecoveryUnlock(cmd *cobra.Command, args []string) {
+	recoverAccess(cmd, args[0], "the recovery passphrase", func(keysFile *KeysFile) ([]byte, error) {
+		recoveryKey, found := findRecoveryKey(keysFile)
+		if !found {
+			return nil, fmt.Errorf("recovery is not enabled, only 'epicenv recovery combine' can be used if the key was split")
+		}
+
+		passphrase, err := readRecoveryPassphrase(false)
+		if err != nil {
+			return nil, fmt.Errorf("error reading recovery passphrase: %w", err)
+		}
+
+		return unwrapRecoveryKey(recoveryKey, passphrase)
+	})
+}
+
+// recoverAccess invites name with the symmetric key that recoverKey recovers, for when nobody invited can do it.
+// method describes how the key was recovered.
+func recoverAccess(cmd *cobra.Command, name, method string, recoverKey func(keysFile *KeysFile) ([]byte, error)) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Adding to root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	err = validateRole(recoveryRoleFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid role")
+	}
+
+	usingPath := recoveryPathFlag != ""
+	if !usingPath {
+		name, err = normalizeUserSpec(name)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid user")
+		}
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	var foundKeys []string
+	if usingPath {
+		keyData, err := os.ReadFile(recoveryPathFlag)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error reading key file %s", recoveryPathFlag)
+		}
+		foundKeys = []string{strings.TrimSpace(string(keyData))}
+	} else {
+		foundKeys, err = getKeysForUser(name)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error getting keys for %s", name)
+		}
+		if len(foundKeys) == 0 {
+			logger.Fatal().Msgf("No keys found for user %s, please add an SSH key to set up EpicEnv!", name)
+		}
+	}
+
+	symKey, err := recoverKey(keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error recovering the key of %s with %s", rootEnv, method)
+	}
+
+	// Already invited users keep their role
+	role := lo.CoalesceOrEmpty(userRole(keysFile, name), recoveryRoleFlag)
+
+	added := 0
+	for _, key := range foundKeys {
+		if lo.ContainsBy(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+			return item.PublicKey == key
+		}) {
+			logger.Debug().Msgf("skipping existing key like %.16s", key)
+			continue
+		}
+
+		encKey, err := newEncryptedKey(name, key, symKey, usingPath, role)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error encrypting with public key")
+		}
+		keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, encKey)
+		added++
+	}
+
+	if added == 0 {
+		logger.Warn().Msgf("Every key of %s is already invited", name)
+		return
+	}
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	logger.Info().Msgf("Invited %d keys of %s as %s with %s", added, name, role, method)
+}
+
+// newRecoveryKey encrypts symKey with a key derived from passphrase
+func newRecoveryKey(symKey []byte, passphrase string, params KDFParams) (EncryptedKey, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return EncryptedKey{}, fmt.Errorf("error in rand.Read: %w", err)
+	}
+	params.Salt = base64.StdEncoding.EncodeToString(salt)
+
+	key, err := deriveRecoveryKey(passphrase, params)
+	if err != nil {
+		return EncryptedKey{}, err
+	}
+
+	encSymKey, err := encryptAESGCM(key, string(symKey), recoveryAdditionalData)
+	if err != nil {
+		return EncryptedKey{}, fmt.Errorf("error in encryptAESGCM: %w", err)
+	}
+
+	return EncryptedKey{
+		Username:           recoveryUsername,
+		EncryptedSharedKey: encSymKey,
+		Algorithm:          algorithmScrypt,
+		// Headless so it isn't synced with a key source, and a reader so it never counts as an admin
+		IsHeadless: true,
+		Role:       roleReader,
+		IsRecovery: true,
+		KDF:        &params,
+	}, nil
+}
+
+// unwrapRecoveryKey decrypts the symmetric key of a recovery entry with passphrase
+func unwrapRecoveryKey(recoveryKey EncryptedKey, passphrase string) ([]byte, error) {
+	if recoveryKey.KDF == nil || recoveryKey.Algorithm != algorithmScrypt {
+		return nil, fmt.Errorf("unsupported recovery key algorithm %q", recoveryKey.Algorithm)
+	}
+
+	key, err := deriveRecoveryKey(passphrase, *recoveryKey.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	symKey, err := decryptAESGCM(key, recoveryKey.EncryptedSharedKey, recoveryAdditionalData)
+	if err != nil {
+		return nil, ErrWrongRecoveryPassphrase
+	}
+
+	return []byte(symKey), nil
+}
+
+func deriveRecoveryKey(passphrase string, params KDFParams) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(params.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding salt: %w", err)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error in scrypt.Key: %w", err)
+	}
+
+	return key, nil
+}
+
+// findRecoveryKey returns the recovery entry of keysFile, if recovery is enabled
+func findRecoveryKey(keysFile *KeysFile) (EncryptedKey, bool) {
+	return lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+		return item.IsRecovery
+	})
+}
+
+// generateRecoveryPassphrase generates 160 random bits as groups of base32 characters
+func generateRecoveryPassphrase() string {
+	random := make([]byte, 20)
+	_, err := rand.Read(random)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error generating random bytes")
+	}
+
+	encoded := base32.StdEncoding.EncodeToString(random)
+	return strings.Join(lo.ChunkString(encoded, 4), "-")
+}
+
+// readRecoveryPassphrase reads the passphrase from EPICENV_RECOVERY_PASSPHRASE or the terminal, asking twice if confirm is set
+func readRecoveryPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv("EPICENV_RECOVERY_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	// IDE might complain, but the cast is necessary for some OSs, because Stdin is a var instead of an untyped const
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", fmt.Errorf("there is no terminal to ask for the recovery passphrase on, set EPICENV_RECOVERY_PASSPHRASE")
+	}
+
+	passphrase := readStdinHidden("Recovery passphrase: ")
+	if confirm && readStdinHidden("Repeat the recovery passphrase: ") != passphrase {
+		return "", fmt.Errorf("the passphrases don't match")
+	}
+
+	return passphrase, nil
+}
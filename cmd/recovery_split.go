@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// sharePrefix marks a decrypted share, so it can't be confused with a passphrase
+const sharePrefix = "epicenv-share-"
+
+// splitCheckAdditionalData binds the check value of a split key to its purpose
+var splitCheckAdditionalData = []byte("epicenv split key check v1")
+
+var recoverySplitCmd = &cobra.Command{
+	Use:   "split USER...",
+	Short: "Split the key into shares for admins, so some of them together can recover it",
+	Long: `Split the symmetric key into one share for each of the given admins, encrypted for their keys.
+
+Any --threshold of them can recover the key together: each of them runs 'epicenv recovery share' and gives
+the printed share to whoever runs 'epicenv recovery combine'. Splitting again replaces the previous shares.
+
+Rotating the key removes the shares, so split it again afterwards.
+
+Examples:
+  epicenv recovery split --threshold 3 --shares 5 alice bob carol dave erin`,
+	Run:  runRecoverySplit,
+	Args: cobra.MinimumNArgs(2),
+}
+
+var recoveryShareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Print your share of the split key",
+	Long: `Print your share of the split key to stdout, to give to whoever runs 'epicenv recovery combine'.
+
+A share alone can't recover the key, but send it over a secure channel anyway.`,
+	Run:  runRecoveryShare,
+	Args: cobra.NoArgs,
+}
+
+var recoveryCombineCmd = &cobra.Command{
+	Use:   "combine USER",
+	Short: "Recover the key from enough shares and invite a user with it",
+	Long: `Recover the symmetric key from the shares of the split key, and invite a user with it.
+
+The shares are read from stdin, one per line, or asked for one at a time on a terminal. Set
+EPICENV_RECOVERY_SHARES to a space separated list of shares to avoid being asked for them.
+
+Their current keys are invited, keeping the role they have if they are already invited. Run it as the user
+being invited, so keys.json is signed by one of their keys.
+
+Examples:
+  epicenv recovery combine alice
+  epicenv recovery combine laptop --path ~/.ssh/id_ed25519.pub`,
+	Run:  runRecoveryCombine,
+	Args: cobra.ExactArgs(1),
+}
+
+var (
+	recoveryThresholdFlag int
+	recoverySharesFlag    int
+)
+
+func init() {
+	recoveryCmd.AddCommand(recoverySplitCmd)
+	recoveryCmd.AddCommand(recoveryShareCmd)
+	recoveryCmd.AddCommand(recoveryCombineCmd)
+
+	recoverySplitCmd.Flags().IntVar(&recoveryThresholdFlag, "threshold", 0, "How many shares are needed to recover the key")
+	recoverySplitCmd.Flags().IntVar(&recoverySharesFlag, "shares", 0, "How many shares to split the key into, one for each user")
+	recoverySplitCmd.MarkFlagRequired("threshold")
+	recoveryCombineCmd.Flags().StringVar(&recoveryPathFlag, "path", "", "Path to a public key file to invite as a headless key")
+	recoveryCombineCmd.Flags().StringVar(&recoveryRoleFlag, "role", roleAdmin, "Role of the invitee if they are not invited yet")
+}
+
+func runRecoverySplit(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Splitting the key of root environment '%s' (overlays share its key)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	holders := normalizeInvitedUsers(keysFile, args)
+	if len(lo.Uniq(holders)) != len(holders) {
+		logger.Fatal().Msg("Each user can only hold one share")
+	}
+	if recoverySharesFlag != 0 && recoverySharesFlag != len(holders) {
+		logger.Fatal().Msgf("Splitting into %d shares needs %d users, got %d", recoverySharesFlag, recoverySharesFlag, len(holders))
+	}
+	for _, username := range holders {
+		if userRole(keysFile, username) != roleAdmin {
+			logger.Fatal().Msgf("'%s' is a %s, only admins can hold shares", username, userRole(keysFile, username))
+		}
+	}
+
+	split, err := newSplitKey(keysFile, symKey, holders, recoveryThresholdFlag)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error splitting the key")
+	}
+
+	replaced := keysFile.Split != nil
+	keysFile.Split = split
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+
+	if replaced {
+		logger.Info().Msg("Replaced the previous shares")
+	}
+	logger.Info().Msgf("Split the key of %s among %s, any %d of them can recover it", rootEnv, strings.Join(holders, ", "), split.Threshold)
+}
+
+func runRecoveryShare(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	if keysFile.Split == nil {
+		logger.Fatal().Msgf("The key of %s is not split", rootEnv)
+	}
+
+	share, err := unwrapWithLocalKeys(keysFile.Split.Shares)
+	if errors.Is(err, ErrNoLocalKey) {
+		logger.Fatal().Msgf("None of your keys hold a share of the key of %s", rootEnv)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error decrypting share")
+	}
+
+	fmt.Println(sharePrefix + base64.RawURLEncoding.EncodeToString(share))
+	logger.Info().Msgf("This is your share, %d are needed to recover the key. Give it to whoever runs 'epicenv recovery combine' over a secure channel", keysFile.Split.Threshold)
+}
+
+func runRecoveryCombine(cmd *cobra.Command, args []string) {
+	recoverAccess(cmd, args[0], "the shares of the split key", func(keysFile *KeysFile) ([]byte, error) {
+		if keysFile.Split == nil {
+			return nil, fmt.Errorf("the key is not split")
+		}
+
+		shares, err := readShares(keysFile.Split.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("error reading shares: %w", err)
+		}
+
+		return combineSplitKey(keysFile.Split, shares)
+	})
+}
+
+// newSplitKey splits symKey into a share for each of holders, encrypted for each of their keys in keysFile
+func newSplitKey(keysFile *KeysFile, symKey []byte, holders []string, threshold int) (*SplitKey, error) {
+	shares, err := shamirSplit(symKey, threshold, len(holders))
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := encryptAESGCM(symKey, "", splitCheckAdditionalData)
+	if err != nil {
+		return nil, fmt.Errorf("error in encryptAESGCM: %w", err)
+	}
+
+	split := &SplitKey{Threshold: threshold, Check: check}
+	for i, username := range holders {
+		for _, item := range keysFile.EncryptedKeys {
+			if item.Username != username {
+				continue
+			}
+
+			encShare, err := newEncryptedKey(username, item.PublicKey, shares[i], item.IsHeadless, "")
+			if err != nil {
+				return nil, err
+			}
+			split.Shares = append(split.Shares, encShare)
+		}
+	}
+
+	return split, nil
+}
+
+// combineSplitKey reconstructs the symmetric key from decrypted shares, and checks it is the key that was split
+func combineSplitKey(split *SplitKey, shares []string) ([]byte, error) {
+	var decoded [][]byte
+	for i, share := range shares {
+		decodedShare, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(share), sharePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%w: share %d is not a share from 'epicenv recovery share'", ErrInvalidShares, i+1)
+		}
+		decoded = append(decoded, decodedShare)
+	}
+
+	if len(decoded) < split.Threshold {
+		return nil, fmt.Errorf("%w: need %d shares, got %d", ErrInvalidShares, split.Threshold, len(decoded))
+	}
+
+	symKey, err := shamirCombine(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decryptAESGCM(symKey, split.Check, splitCheckAdditionalData); err != nil {
+		return nil, fmt.Errorf("%w: the shares don't recover the key, are they all from the current split?", ErrInvalidShares)
+	}
+
+	return symKey, nil
+}
+
+// readShares reads count shares from EPICENV_RECOVERY_SHARES, the terminal, or stdin
+func readShares(count int) ([]string, error) {
+	if shares := os.Getenv("EPICENV_RECOVERY_SHARES"); shares != "" {
+		return strings.Fields(shares), nil
+	}
+
+	var shares []string
+	// IDE might complain, but the cast is necessary for some OSs, because Stdin is a var instead of an untyped const
+	if term.IsTerminal(int(syscall.Stdin)) {
+		for i := 1; i <= count; i++ {
+			shares = append(shares, readStdinHidden(fmt.Sprintf("Share %d of %d: ", i, count)))
+		}
+		return shares, nil
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for len(shares) < count && scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			shares = append(shares, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading stdin: %w", err)
+	}
+
+	return shares, nil
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestRecoveryKey(t *testing.T) {
+	// Cheap parameters, the defaults take around a second
+	params := KDFParams{N: 1 << 10, R: 8, P: 1}
+	symKey := generateAESKey()
+	passphrase := generateRecoveryPassphrase()
+	if len(passphrase) < minRecoveryPassphraseLength {
+		t.Fatalf("generated passphrase %q is too short", passphrase)
+	}
+
+	recoveryKey, err := newRecoveryKey(symKey, passphrase, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recoveryKey.IsRecovery || keyRole(recoveryKey) == roleAdmin {
+		t.Fatalf("unexpected recovery key %+v", recoveryKey)
+	}
+
+	unwrapped, err := unwrapRecoveryKey(recoveryKey, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, symKey) {
+		t.Fatal("symmetric key mismatch")
+	}
+
+	if _, err := unwrapRecoveryKey(recoveryKey, passphrase+"x"); !errors.Is(err, ErrWrongRecoveryPassphrase) {
+		t.Fatalf("expected ErrWrongRecoveryPassphrase, got %v", err)
+	}
+
+	// The recovery key can't keep the environment manageable
+	keysFile := &KeysFile{EncryptedKeys: []EncryptedKey{{Username: "alice", Role: roleAdmin}, recoveryKey}}
+	if hasAdminWithout(keysFile, []string{"alice"}) {
+		t.Fatal("the recovery key should not count as an admin")
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	var keysFile KeysFile
+	privateKeys := make(map[string][]byte)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		publicKey, privateKey, err := generateKeyPair("ed25519", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, EncryptedKey{Username: username, PublicKey: publicKey, Role: roleAdmin})
+		privateKeys[username] = privateKey
+	}
+
+	symKey := generateAESKey()
+	split, err := newSplitKey(&keysFile, symKey, []string{"alice", "bob", "carol"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each holder decrypts their own share
+	shares := make(map[string]string)
+	for username, privateKey := range privateKeys {
+		t.Setenv("EPICENV_PRIVATE_KEY", string(privateKey))
+		share, err := unwrapWithLocalKeys(split.Shares)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares[username] = sharePrefix + base64.RawURLEncoding.EncodeToString(share)
+	}
+
+	combined, err := combineSplitKey(split, []string{shares["carol"], shares["alice"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(combined, symKey) {
+		t.Fatal("symmetric key mismatch")
+	}
+
+	if _, err := combineSplitKey(split, []string{shares["bob"]}); !errors.Is(err, ErrInvalidShares) {
+		t.Fatalf("expected ErrInvalidShares for too few shares, got %v", err)
+	}
+
+	// Shares of another split don't combine with these
+	other, err := newSplitKey(&keysFile, symKey, []string{"alice", "bob", "carol"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_PRIVATE_KEY", string(privateKeys["bob"]))
+	otherShare, err := unwrapWithLocalKeys(other.Shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := combineSplitKey(split, []string{shares["alice"], sharePrefix + base64.RawURLEncoding.EncodeToString(otherShare)}); !errors.Is(err, ErrInvalidShares) {
+		t.Fatalf("expected ErrInvalidShares for mixed splits, got %v", err)
+	}
+}
+
+func TestRemoveUsersRemovesSplit(t *testing.T) {
+	keysFile := &KeysFile{
+		EncryptedKeys: []EncryptedKey{{Username: "alice"}, {Username: "bob"}, {Username: "carol"}},
+		Split:         &SplitKey{Threshold: 2, Shares: []EncryptedKey{{Username: "alice"}, {Username: "bob"}}},
+	}
+
+	// carol holds no share
+	removeUsers(keysFile, []string{"carol"})
+	if keysFile.Split == nil {
+		t.Fatal("the split was removed, but carol held no share")
+	}
+
+	removeUsers(keysFile, []string{"bob"})
+	if keysFile.Split != nil {
+		t.Fatalf("the split was kept after removing bob, who held a share: %+v", keysFile.Split)
+	}
+}
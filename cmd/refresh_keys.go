@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// refreshKeysCmd represents the refresh-keys command
+var refreshKeysCmd = &cobra.Command{
+	Use:   "refresh-keys [USER...]",
+	Short: "Sync invited users with their current public keys",
+	Long: `Fetch the current public keys of invited users, and update the EpicEnv to match.
+
+Keys the user no longer has are removed. New keys are only given access with --accept-new, after you
+have checked their fingerprints with the user, since they could also have been added by someone who took
+over their account. Headless keys are never changed. Refreshes all invited users if none are given.
+
+Removed keys could still decrypt anything they had access to before, rotate the key if they were compromised.
+
+Examples:
+  epicenv refresh-keys                  # Refresh all users
+  epicenv refresh-keys alice gitlab:bob # Refresh specific users
+  epicenv refresh-keys alice --accept-new # Give alice's new keys access`,
+	Run: runRefreshKeys,
+}
+
+var acceptNewFlag bool
+
+func init() {
+	rootCmd.AddCommand(refreshKeysCmd)
+	refreshKeysCmd.Flags().BoolVar(&acceptNewFlag, "accept-new", false, "Give new keys of already invited users access")
+}
+
+func runRefreshKeys(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Refreshing keys of root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	symKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	invitedUsers := lo.Uniq(lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+		return item.Username, !item.IsHeadless
+	}))
+
+	usernames := invitedUsers
+	if len(args) > 0 {
+		usernames = nil
+		for _, arg := range args {
+			username, err := normalizeUserSpec(arg)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("invalid user")
+			}
+			if !lo.Contains(invitedUsers, username) {
+				logger.Fatal().Msgf("User '%s' is not invited to this environment", username)
+			}
+			usernames = append(usernames, username)
+		}
+	}
+
+	changed := false
+	for _, username := range usernames {
+		foundKeys, err := getKeysForUser(username)
+		if err != nil {
+			logger.Warn().Err(err).Msgf("%s: could not fetch keys, leaving them as is", username)
+			continue
+		}
+		if len(foundKeys) == 0 {
+			logger.Warn().Msgf("%s: no keys found, leaving them as is. Use 'epicenv uninvite %s' to remove them", username, username)
+			continue
+		}
+
+		newKeys, _ := diffUserKeys(keysFile, username, foundKeys)
+		if len(newKeys) > 0 && !acceptNewFlag {
+			logNewKeys(username, newKeys)
+			logger.Warn().Msgf("%s: skipped, check the new keys with them and run again with --accept-new", username)
+			continue
+		}
+
+		added, removed, err := syncUserKeys(keysFile, username, foundKeys, symKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error updating keys for %s", username)
+		}
+
+		if added == 0 && removed == 0 {
+			logger.Info().Msgf("%s: unchanged", username)
+			continue
+		}
+
+		logger.Info().Msgf("%s: %d keys added, %d keys removed", username, added, removed)
+		changed = true
+	}
+
+	if !changed {
+		logger.Info().Msg("No changes")
+		return
+	}
+
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error writing keys file")
+	}
+}
+
+// syncUserKeys makes the keys of username in keysFile match foundKeys, giving new keys access to symKey.
+// Returns the number of keys that were added and removed.
+func syncUserKeys(keysFile *KeysFile, username string, foundKeys []string, symKey []byte) (int, int, error) {
+	newKeys, removedKeys := diffUserKeys(keysFile, username, foundKeys)
+	role := userRole(keysFile, username)
+	expiry := userExpiresAt(keysFile, username)
+
+	keysFile.EncryptedKeys = lo.Filter(keysFile.EncryptedKeys, func(item EncryptedKey, index int) bool {
+		return item.Username != username || item.IsHeadless || !lo.Contains(removedKeys, item.PublicKey)
+	})
+	for i := range keysFile.Groups {
+		keysFile.Groups[i].EncryptedKeys = lo.Filter(keysFile.Groups[i].EncryptedKeys, func(item EncryptedKey, index int) bool {
+			return item.Username != username || item.IsHeadless || !lo.Contains(removedKeys, item.PublicKey)
+		})
+	}
+
+	for _, key := range newKeys {
+		if lo.ContainsBy(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+			return samePublicKey(item.PublicKey, key)
+		}) {
+			// Someone else already has this key, don't give it to a second user
+			logger.Warn().Msgf("skipping key like %.16s for %s, it is already invited", key, username)
+			continue
+		}
+
+		encKey, err := newEncryptedKey(username, key, symKey, false, role)
+		if err != nil {
+			return 0, 0, err
+		}
+		encKey.ExpiresAt = expiry
+		keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, encKey)
+	}
+
+	added := len(lo.Filter(keysFile.EncryptedKeys, func(item EncryptedKey, index int) bool {
+		return item.Username == username && lo.Contains(newKeys, item.PublicKey)
+	}))
+
+	if added > 0 {
+		err := addNewKeysToGroups(keysFile, username)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return added, len(removedKeys), nil
+}
+
+// addNewKeysToGroups gives the keys of username that were just added the keys of the groups username is a member of.
+// New keys can only be added to groups we are a member of, the others are warned about.
+func addNewKeysToGroups(keysFile *KeysFile, username string) error {
+	for i := range keysFile.Groups {
+		group := &keysFile.Groups[i]
+		if !lo.Contains(groupMembers(group), username) {
+			continue
+		}
+
+		groupKey, err := unwrapGroupKey(group)
+		if errors.Is(err, ErrNotGroupMember) {
+			logger.Warn().Msgf("%s's new keys are not in group '%s', a member of it has to run 'epicenv group add %s %s'", username, group.Name, group.Name, username)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error decrypting the key of group %s: %w", group.Name, err)
+		}
+
+		_, err = addGroupMember(keysFile, group, groupKey, username)
+		if err != nil {
+			return fmt.Errorf("error adding %s's new keys to group %s: %w", username, group.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// diffUserKeys compares the invited keys of username with foundKeys, by the key alone like samePublicKey.
+// Returns the keys that are not invited yet, and the invited keys that are no longer in foundKeys.
+func diffUserKeys(keysFile *KeysFile, username string, foundKeys []string) ([]string, []string) {
+	currentKeys := lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+		return item.PublicKey, item.Username == username && !item.IsHeadless
+	})
+	newKeys := lo.Filter(foundKeys, func(key string, index int) bool {
+		_, found := matchPublicKey(currentKeys, key)
+		return !found
+	})
+	removedKeys := lo.Filter(currentKeys, func(key string, index int) bool {
+		_, found := matchPublicKey(foundKeys, key)
+		return !found
+	})
+	return newKeys, removedKeys
+}
+
+// logNewKeys warns about keys that appeared for an already invited user, so they can be checked out of band
+func logNewKeys(username string, newKeys []string) {
+	logger.Warn().Msgf("%s has %d new keys that are not invited yet:", username, len(newKeys))
+	for _, key := range newKeys {
+		fingerprint, err := keyFingerprint(key)
+		if err != nil {
+			fingerprint = err.Error()
+		}
+		logger.Warn().Msgf("  %s %s", keyType(key), fingerprint)
+	}
+}
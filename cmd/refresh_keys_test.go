@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestSyncUserKeys(t *testing.T) {
+	var keys []string
+	for range 4 {
+		publicKey, _, err := generateKeyPair("ed25519", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, publicKey)
+	}
+	oldKey, keptKey, newKey, headlessKey := keys[0], keys[1], keys[2], keys[3]
+
+	keysFile := &KeysFile{
+		EncryptedKeys: []EncryptedKey{
+			{Username: "alice", PublicKey: oldKey},
+			{Username: "alice", PublicKey: keptKey, EncryptedSharedKey: "kept"},
+			{Username: "alice", PublicKey: headlessKey, IsHeadless: true},
+			{Username: "bob", PublicKey: newKey},
+		},
+	}
+
+	// bob's key must not be given to alice as well
+	added, removed, err := syncUserKeys(keysFile, "alice", []string{keptKey, newKey}, generateAESKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 || removed != 1 {
+		t.Fatalf("expected 0 added and 1 removed, got %d and %d", added, removed)
+	}
+
+	keysFile.EncryptedKeys = lo.Filter(keysFile.EncryptedKeys, func(item EncryptedKey, index int) bool {
+		return item.Username != "bob"
+	})
+	added, removed, err = syncUserKeys(keysFile, "alice", []string{keptKey, newKey}, generateAESKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || removed != 0 {
+		t.Fatalf("expected 1 added and 0 removed, got %d and %d", added, removed)
+	}
+
+	got := lo.Map(keysFile.EncryptedKeys, func(item EncryptedKey, index int) string {
+		return item.PublicKey
+	})
+	if len(got) != 3 || !lo.Every(got, []string{keptKey, headlessKey, newKey}) {
+		t.Fatalf("unexpected keys %v", got)
+	}
+	if keysFile.EncryptedKeys[0].EncryptedSharedKey != "kept" {
+		t.Fatal("existing key was re-encrypted")
+	}
+}
+
+func TestDiffUserKeysIgnoresComments(t *testing.T) {
+	publicKey, _, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysFile := &KeysFile{EncryptedKeys: []EncryptedKey{{Username: "alice", PublicKey: publicKey + " alice@laptop"}}}
+
+	// The provider's copy has no comment
+	newKeys, removedKeys := diffUserKeys(keysFile, "alice", []string{publicKey + "\n"})
+	if len(newKeys) != 0 || len(removedKeys) != 0 {
+		t.Fatalf("expected no changes, got new %v and removed %v", newKeys, removedKeys)
+	}
+}
+
+func TestAddNewKeysToGroups(t *testing.T) {
+	oldPublic, oldPrivate, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPublic, _, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_PRIVATE_KEY", string(oldPrivate))
+
+	keysFile := &KeysFile{EncryptedKeys: []EncryptedKey{{Username: "alice", PublicKey: oldPublic}}}
+	group := Group{Name: "ops"}
+	if _, err := addGroupMember(keysFile, &group, generateAESKey(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	keysFile.Groups = []Group{group, {Name: "payments"}}
+
+	// alice's new key was accepted with invite --accept-new
+	keysFile.EncryptedKeys = append(keysFile.EncryptedKeys, EncryptedKey{Username: "alice", PublicKey: newPublic})
+	if err := addNewKeysToGroups(keysFile, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(keysFile.Groups[0].EncryptedKeys); got != 2 {
+		t.Fatalf("ops has %d keys, want both of alice's", got)
+	}
+	if got := len(keysFile.Groups[1].EncryptedKeys); got != 0 {
+		t.Fatalf("payments has %d keys, alice is not a member", got)
+	}
+}
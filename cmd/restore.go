@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore REV [KEY]",
+	Short: "Set values back to what they were at a commit",
+	Long: `Set the values of an environment, or only KEY, back to what they were at a commit.
+
+Values are encrypted with the current key, in the group they were in, and values that are the same are left
+alone. Variables that were added after the commit are not removed, they are listed so you can rm them. Only the
+values of the environment itself are restored, not of the environments it overlays. Personal values are not
+committed, so they can't be restored. Nothing is restored if a value was in a group that was deleted since, or
+that you are no longer a member of.
+
+Examples:
+  epicenv restore HEAD~1 DATABASE_URL -e prod
+  epicenv restore 1a2b3c4d`,
+	Run:  runRestore,
+	Args: cobra.RangeArgs(1, 2),
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runRestore(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	commit, err := gitResolveCommit(getEpicEnvPath(), args[0])
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error finding commit %s, is the .epicenv directory in a git repository?", args[0])
+	}
+
+	secretsFile, err := readSecretsAt(commit.Hash, env)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Fatal().Msgf("%s has no values at %.8s", env, commit.Hash)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading secrets file")
+	}
+
+	items := secretsFile.Secrets
+	if len(args) > 1 {
+		item, found := lo.Find(items, func(item EncryptedSecret) bool {
+			return item.Name == args[1]
+		})
+		if !found {
+			logger.Fatal().Msgf("%s was not in %s at %.8s, rm it to remove it", args[1], env, commit.Hash)
+		}
+		items = []EncryptedSecret{item}
+	}
+
+	keys, err := loadEnvKeyring(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	current, err := readSecretsFile(env, false)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Fatal().Err(err).Msg("error reading secrets file")
+	}
+	if current == nil {
+		current = &SecretsFile{}
+	}
+
+	// Check the groups and decrypt everything first, so we don't stop halfway through writing the values
+	type restoredValue struct {
+		item  EncryptedSecret
+		value string
+	}
+	var values []restoredValue
+	missingGroup := false
+	for _, item := range items {
+		if item.Personal {
+			if len(args) > 1 {
+				logger.Fatal().Msgf("%s was personal at %.8s, personal values are not committed", item.Name, commit.Hash)
+			}
+			continue
+		}
+
+		// Values stay in the group they are in now when they are set again
+		group := item.Group
+		if existing, found := lo.Find(current.Secrets, func(existing EncryptedSecret) bool {
+			return existing.Name == item.Name
+		}); found && group == "" {
+			group = existing.Group
+		}
+		if group != "" {
+			if _, err := keys.groupKeys.key(group); err != nil {
+				logger.Error().Err(err).Msgf("Can't restore %s in group %s", item.Name, group)
+				missingGroup = true
+				continue
+			}
+		}
+
+		value, _, ok := keys.decrypt(item)
+		if !ok {
+			logger.Warn().Msgf("Can't decrypt %s at %.8s, skipping it", item.Name, commit.Hash)
+			continue
+		}
+		values = append(values, restoredValue{item, value})
+	}
+	if missingGroup {
+		logger.Fatal().Msg("Nothing was restored, restore the other values one at a time")
+	}
+
+	restored, changed := 0, 0
+	for _, value := range values {
+		restored++
+		if setEnvVar(env, value.item.Name, value.value, false, value.item.Group) {
+			changed++
+			logger.Info().Msgf("Restored %s", value.item.Name)
+		}
+	}
+
+	if len(args) == 1 {
+		added := lo.FilterMap(current.Secrets, func(item EncryptedSecret, index int) (string, bool) {
+			return item.Name, !lo.ContainsBy(secretsFile.Secrets, func(old EncryptedSecret) bool {
+				return old.Name == item.Name
+			})
+		})
+		if len(added) > 0 {
+			logger.Warn().Msgf("Added after %.8s, rm them if they shouldn't be there: %s", commit.Hash, strings.Join(added, ", "))
+		}
+	}
+
+	logger.Info().Msgf("Restored %d values of %s to %.8s, %d of them changed", restored, env, commit.Hash, changed)
+}
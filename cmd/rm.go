@@ -28,6 +28,8 @@ func runRm(cmd *cobra.Command, args []string) {
 	env := getEnvOrFlag(cmd)
 	envMap := loadEnv(env)
 
+	requireRole(env, roleWriter)
+
 	envVar, exists := envMap[key]
 	if !exists {
 		logger.Warn().Msgf("The environment variable %s doesn't exist!", key)
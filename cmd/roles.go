@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	// roleAdmin can change who is invited
+	roleAdmin = "admin"
+	// roleWriter can change shared values
+	roleWriter = "writer"
+	// roleReader can only read values, and set their own personal values
+	roleReader = "reader"
+)
+
+// roles in order of increasing access
+var roles = []string{roleReader, roleWriter, roleAdmin}
+
+var ErrInsufficientRole = errors.New("insufficient role")
+
+// keyRole returns the role of an invited key, keys invited before roles existed are admins
+func keyRole(key EncryptedKey) string {
+	if key.Role == "" {
+		return roleAdmin
+	}
+	return key.Role
+}
+
+// hasRole checks whether role has at least the access of required
+func hasRole(role, required string) bool {
+	return lo.IndexOf(roles, role) >= lo.IndexOf(roles, required)
+}
+
+func validateRole(role string) error {
+	if !lo.Contains(roles, role) {
+		return fmt.Errorf("unknown role %q, use one of %s", role, strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// userRole returns the role of an invited user, or the empty string if they are not invited
+func userRole(keysFile *KeysFile, username string) string {
+	key, found := lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+		return item.Username == username
+	})
+	if !found {
+		return ""
+	}
+	return keyRole(key)
+}
+
+// localRole returns the highest role of our local keys that are invited
+func localRole(keysFile *KeysFile) (string, error) {
+	keyPairs := findPrivateKeysForPublicKeys(lo.Map(keysFile.EncryptedKeys, func(item EncryptedKey, index int) string {
+		return item.PublicKey
+	}))
+	if len(keyPairs) == 0 {
+		return "", fmt.Errorf("did not find any local private keys matching a known public key")
+	}
+
+	role := roleReader
+	for _, kp := range keyPairs {
+		key, _ := lo.Find(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+			return item.PublicKey == kp.publicKeyContent
+		})
+		if hasRole(keyRole(key), role) {
+			role = keyRole(key)
+		}
+	}
+
+	return role, nil
+}
+
+// roleChanges describes the keys that were invited, uninvited, or changed role from before to after
+func roleChanges(before, after *KeysFile) []string {
+	roleOf := func(keysFile *KeysFile) map[string]EncryptedKey {
+		return lo.SliceToMap(keysFile.EncryptedKeys, func(item EncryptedKey) (string, EncryptedKey) {
+			return encryptedKeyID(item), item
+		})
+	}
+	beforeKeys, afterKeys := roleOf(before), roleOf(after)
+
+	var changes []string
+	for _, item := range after.EncryptedKeys {
+		old, found := beforeKeys[encryptedKeyID(item)]
+		switch {
+		case !found:
+			changes = append(changes, fmt.Sprintf("%s was invited as %s", item.Username, keyRole(item)))
+		case keyRole(old) != keyRole(item):
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", item.Username, keyRole(old), keyRole(item)))
+		}
+	}
+	for _, item := range before.EncryptedKeys {
+		if _, found := afterKeys[encryptedKeyID(item)]; !found {
+			changes = append(changes, fmt.Sprintf("%s was uninvited", item.Username))
+		}
+	}
+
+	return changes
+}
+
+// requireRole exits unless our local keys have at least role in env. Roles come from the keys.json we
+// trust (see verifyKeysFile), so editing keys.json doesn't give anyone a role. Admins change keys.json,
+// so they are refused if it was changed by someone they don't trust, instead of signing the change.
+func requireRole(env, role string) {
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	keysFile, err := verifyKeysFile(rootEnv)
+	if keysFile == nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+	if err != nil && !errors.Is(err, ErrUnsigned) && role == roleAdmin {
+		logger.Fatal().Err(err).Msgf("Refusing to change %s, it was not changed by an admin you trust", keysFilePath(rootEnv))
+	}
+
+	ourRole, err := localRole(keysFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error finding your role")
+	}
+
+	if !hasRole(ourRole, role) {
+		logger.Fatal().Msgf("You are a %s in %s, this needs the %s role", ourRole, rootEnv, role)
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	keysFile := &KeysFile{
+		EncryptedKeys: []EncryptedKey{
+			{Username: "legacy"},
+			{Username: "alice", Role: roleWriter},
+			{Username: "bob", Role: roleReader},
+		},
+	}
+
+	for username, want := range map[string]string{
+		"legacy": roleAdmin,
+		"alice":  roleWriter,
+		"bob":    roleReader,
+		"eve":    "",
+	} {
+		if got := userRole(keysFile, username); got != want {
+			t.Errorf("%s: got role %q, want %q", username, got, want)
+		}
+	}
+
+	if !hasRole(roleAdmin, roleWriter) || !hasRole(roleWriter, roleWriter) || hasRole(roleReader, roleWriter) {
+		t.Error("roles are not ordered reader < writer < admin")
+	}
+	if hasRole("", roleReader) {
+		t.Error("not being invited should not be a role")
+	}
+
+	if err := validateRole("owner"); err == nil {
+		t.Error("expected an error for an unknown role")
+	}
+}
+
+func TestRoleChanges(t *testing.T) {
+	before := &KeysFile{EncryptedKeys: []EncryptedKey{
+		{Username: "alice", PublicKey: "pk-alice", Role: roleAdmin},
+		{Username: "bob", PublicKey: "pk-bob", Role: roleReader},
+		{Username: "carol", PublicKey: "pk-carol", Role: roleWriter},
+	}}
+	after := &KeysFile{EncryptedKeys: []EncryptedKey{
+		{Username: "alice", PublicKey: "pk-alice"},
+		{Username: "bob", PublicKey: "pk-bob", Role: roleAdmin},
+		{Username: "eve", PublicKey: "pk-eve", Role: roleReader},
+	}}
+
+	want := []string{"bob changed from reader to admin", "eve was invited as reader", "carol was uninvited"}
+	if got := roleChanges(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("roleChanges() = %v, want %v", got, want)
+	}
+	if got := roleChanges(before, before); len(got) != 0 {
+		t.Errorf("roleChanges() of the same keys = %v, want none", got)
+	}
+}
@@ -27,6 +27,9 @@ func Execute() {
 	}
 }
 
+var identityFlag string
+
 func init() {
 	rootCmd.PersistentFlags().StringP("environment", "e", "", "Specify the environment, will use the current by default if one is set")
+	rootCmd.PersistentFlags().StringVar(&identityFlag, "identity", "", "Path to a private key to use instead of searching $HOME/.ssh (or EPICENV_IDENTITY)")
 }
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// rotateKeyCmd represents the rotate-key command
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Rotate the symmetric key and re-encrypt every layer",
+	Long: `Rotate the symmetric key of an environment.
+
+A new symmetric key is generated, the shared secrets of the root environment and every overlay
+on top of it are re-encrypted, and the new key is encrypted for every invited key.
+
+Personal secrets are migrated to the new key the next time each collaborator loads the environment.
+Values in groups are encrypted with their group's key, and are not changed. Recovery is disabled, since the
+new key can't be encrypted without the recovery passphrase, and the shares of a split key are removed.
+
+This is not a replacement for rotating the secrets themselves!
+
+Example:
+  epicenv rotate-key -e prod`,
+	Run: runRotateKey,
+}
+
+func init() {
+	rootCmd.AddCommand(rotateKeyCmd)
+}
+
+func runRotateKey(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Rotating the key of root environment '%s' (overlays share its key)", rootEnv)
+	}
+
+	oldKey, err := loadSymmetricKey(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error loading symmetric key")
+	}
+
+	requireRole(rootEnv, roleAdmin)
+
+	generation, rotated, err := rotateSymmetricKey(rootEnv, oldKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error rotating symmetric key")
+	}
+
+	logger.Info().Msgf("Rotated the key for %s to generation %d, re-encrypted %d shared values", rootEnv, generation, rotated)
+}
+
+// rotateSymmetricKey generates a new symmetric key for rootEnv, re-encrypts the shared secrets of rootEnv
+// and all of its overlays, and encrypts the new key for every invited key.
+// Returns the new generation and the number of re-encrypted values.
+func rotateSymmetricKey(rootEnv string, oldKey []byte) (int, int, error) {
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading keys file: %w", err)
+	}
+
+	environments, err := getEnvironmentsForRoot(rootEnv)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error finding overlays of %s: %w", rootEnv, err)
+	}
+
+	newKey := generateAESKey()
+
+	// Re-encrypt everything in memory first, so we don't write anything if a value fails to decrypt
+	rotatedSecrets := make(map[string]*SecretsFile)
+	rotated := 0
+	for _, env := range environments {
+		secretsFile, err := readSecretsFile(env, false)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("error reading secrets file for %s: %w", env, err)
+		}
+
+		oldKeys := &envKeyring{env: env, keysFile: keysFile, symKey: oldKey}
+		for i, item := range secretsFile.Secrets {
+			if item.Personal {
+				// Personal values live in each collaborator's personal secrets
+				continue
+			}
+			if item.Group != "" {
+				// Values in groups are encrypted with their group's key
+				continue
+			}
+
+			// Re-encrypting would bind a value that was copied in from elsewhere
+			if err := checkSecretBound(keysFile, item); err != nil {
+				return 0, 0, err
+			}
+
+			// Values may still have a previous key, if an earlier rotation stopped before re-encrypting them
+			decrypted, _, ok := oldKeys.decrypt(item)
+			if !ok {
+				return 0, 0, fmt.Errorf("error decrypting %s in %s with the current or a previous key", item.Name, env)
+			}
+			secretsFile.Secrets[i], err = encryptSecret(newKey, env, item.Name, false, decrypted)
+			if err != nil {
+				return 0, 0, fmt.Errorf("error encrypting %s in %s: %w", item.Name, env, err)
+			}
+			secretsFile.Secrets[i].NeedsRotation = item.NeedsRotation
+			rotated++
+		}
+
+		rotatedSecrets[env] = secretsFile
+	}
+
+	// Keep the older keys around (encrypted with the new key) so personal secrets can be migrated
+	var previousKeys []PreviousKey
+	for _, previous := range keysFile.PreviousKeys {
+		previousKey, err := previousSymmetricKey(keysFile, oldKey, previous.Generation)
+		if err != nil {
+			return 0, 0, err
+		}
+		encrypted, err := encryptAESGCM(newKey, string(previousKey), nil)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error encrypting previous key: %w", err)
+		}
+		previousKeys = append(previousKeys, PreviousKey{Generation: previous.Generation, EncryptedKey: encrypted})
+	}
+	encryptedOldKey, err := encryptAESGCM(newKey, string(oldKey), nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error encrypting previous key: %w", err)
+	}
+	previousKeys = append(previousKeys, PreviousKey{Generation: keysFile.Generation, EncryptedKey: encryptedOldKey})
+
+	// We don't have the recovery passphrase to encrypt the new key with
+	if _, found := findRecoveryKey(keysFile); found {
+		removeUsers(keysFile, []string{recoveryUsername})
+		logger.Warn().Msgf("Recovery was disabled for %s, run 'epicenv recovery enable' to enable it with the new key", rootEnv)
+	}
+	if keysFile.Split != nil {
+		keysFile.Split = nil
+		logger.Warn().Msgf("The split key of %s was removed, run 'epicenv recovery split' to split the new key", rootEnv)
+	}
+
+	for i, item := range keysFile.EncryptedKeys {
+		keysFile.EncryptedKeys[i].EncryptedSharedKey, keysFile.EncryptedKeys[i].Algorithm, err = encryptWithPublicKey(newKey, item.PublicKey)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error encrypting new key for %s: %w", item.Username, err)
+		}
+	}
+	// Every key was just wrapped with the current algorithms
+	keysFile.Version = currentKeysFileVersion
+	keysFile.Generation++
+	keysFile.PreviousKeys = previousKeys
+
+	// Write the keys first, so the new key is never lost. If we fail after this, the values that weren't written
+	// yet are decrypted with the old key from the previous keys, and rotating again re-encrypts them.
+	err = writeKeysFile(rootEnv, *keysFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error writing keys file: %w", err)
+	}
+
+	for env, secretsFile := range rotatedSecrets {
+		err = writeSecretsFile(env, *secretsFile, false)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error writing secrets file for %s: %w", env, err)
+		}
+	}
+
+	return keysFile.Generation, rotated, nil
+}
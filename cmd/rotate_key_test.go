@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+)
+
+func TestInterruptedRotation(t *testing.T) {
+	previousDir := epicEnvDir
+	epicEnvDir = t.TempDir()
+	t.Cleanup(func() { epicEnvDir = previousDir })
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("EPICENV_AUTH_SOCK", "")
+
+	publicKey, privateKey, err := generateKeyPair("ed25519", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EPICENV_PRIVATE_KEY", string(privateKey))
+
+	oldKey := generateAESKey()
+	encryptedKey, err := newEncryptedKey("alice", publicKey, oldKey, false, roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeysFile("local", KeysFile{EncryptedKeys: []EncryptedKey{encryptedKey}}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := encryptSecret(oldKey, "local", "API_TOKEN", false, "supersecretvalue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSecretsFile("local", SecretsFile{Secrets: []EncryptedSecret{secret}}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotation stops after writing keys.json, before the secrets are written
+	oldSecrets, err := os.ReadFile(secretsFilePath("local", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rotateSymmetricKey("local", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretsFilePath("local", false), oldSecrets, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadEnvKeyring("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envMap := make(map[string]loadedEnvVar)
+	loadEnvLayer("local", keys.symKey, keys.keysFile, keys.groupKeys, envMap, make(map[string]string))
+	if got := envMap["API_TOKEN"].Value; got != "supersecretvalue" {
+		t.Fatalf("API_TOKEN = %q after an interrupted rotation, want the value from the previous key", got)
+	}
+
+	// Rotating again finishes it
+	if _, rotated, err := rotateSymmetricKey("local", keys.symKey); err != nil || rotated != 1 {
+		t.Fatalf("rotating again: rotated = %d, err = %v", rotated, err)
+	}
+	keys, err = loadEnvKeyring("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsFile, err := readSecretsFile("local", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, stale, ok := keys.decrypt(secretsFile.Secrets[0]); !ok || stale || value != "supersecretvalue" {
+		t.Fatalf("decrypt() = %q, stale %v, ok %v, want the value with the current key", value, stale, ok)
+	}
+}
@@ -24,6 +24,9 @@ Use -p to set a personal variable.
 
 Omit [VALUE] to collect from stdin
 
+Use -g to set a value that only members of a group can decrypt, see 'epicenv group --help'. Values in a group
+stay in it when they are set again, to take a value out of a group, first rm the variable, then set it again.
+
 If you attempt to normal set a personal variable, it will update the personal variable instead. To make a personal variable shared, first rm the variable, then set it again as shared.`,
 	Run:        runSet,
 	Args:       cobra.RangeArgs(1, 2),
@@ -34,6 +37,7 @@ func init() {
 	rootCmd.AddCommand(setCmd)
 
 	setCmd.Flags().BoolP("personal", "p", false, "Set this as a personal environment if it doesn't exist")
+	setCmd.Flags().StringP("group", "g", "", "Encrypt the value for the members of this group only")
 }
 
 func runSet(cmd *cobra.Command, args []string) {
@@ -51,7 +55,11 @@ func runSet(cmd *cobra.Command, args []string) {
 	if cmd.Flag("personal") != nil {
 		personal = cmd.Flag("personal").Value.String() == "true"
 	}
-	setEnvVar(env, key, val, personal)
+	group := cmd.Flag("group").Value.String()
+	if !setEnvVar(env, key, val, personal, group) {
+		logger.Info().Msgf("%s is unchanged", key)
+		return
+	}
 
 	logger.Info().Msgf("Updated %s", key)
 
@@ -60,7 +68,13 @@ func runSet(cmd *cobra.Command, args []string) {
 	}
 }
 
-func setEnvVar(env, key, val string, personal bool) {
+// setEnvVar encrypts and writes val, unless it is already the value of key in env.
+// Returns whether it changed.
+func setEnvVar(env, key, val string, personal bool, group string) bool {
+	if personal && group != "" {
+		logger.Fatal().Msg("Personal values can't be in a group")
+	}
+
 	envMap := loadEnv(env)
 	// Check if we are setting a personal env var (check merged env for personal status)
 
@@ -86,9 +100,12 @@ func setEnvVar(env, key, val string, personal bool) {
 		logger.Fatal().Err(err).Msg("error loading symmetric key")
 	}
 
-	encrypted, err := encryptAESGCM(symKey, val)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("error encrypting value")
+	if personal {
+		// Make sure we don't mix values from different key generations in the personal secrets
+		err = migratePersonalSecrets(env, secretsFile, symKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error migrating personal secrets to the current key")
+		}
 	}
 
 	// Check if key exists in THIS environment's secrets (not merged)
@@ -96,28 +113,73 @@ func setEnvVar(env, key, val string, personal bool) {
 		return item.Name == key
 	})
 
+	// Values stay in their group
+	if idx != -1 && group == "" && secretsFile.Secrets[idx].Group != "" {
+		group = secretsFile.Secrets[idx].Group
+		logger.Debug().Msgf("Var %s is in group %s, keeping it there", key, group)
+	}
+
+	// Personal values need a placeholder in the shared secrets, unless someone already set one
+	var sharedSecrets *SecretsFile
+	if personal && idx == -1 {
+		sharedSecrets, err = readSecretsFile(env, false)
+		if errors.Is(err, os.ErrNotExist) {
+			sharedSecrets = &SecretsFile{}
+		} else if err != nil {
+			logger.Fatal().Err(err).Msg("error reading shared secrets file")
+		}
+
+		if lo.ContainsBy(sharedSecrets.Secrets, func(item EncryptedSecret) bool {
+			return item.Name == key && !item.Personal
+		}) {
+			// e.g. a value in a group we are not a member of
+			logger.Fatal().Msgf("Attempting to set an existing shared env var \"%s\" as personal, please rm this env var and set again", key)
+		}
+		if lo.ContainsBy(sharedSecrets.Secrets, func(item EncryptedSecret) bool {
+			return item.Name == key && item.Personal
+		}) {
+			sharedSecrets = nil
+		}
+	}
+
+	// Readers can only update their own personal values, anything else changes the shared secrets
+	if !personal || sharedSecrets != nil {
+		requireRole(env, roleWriter)
+	}
+
+	if envVar, exists := envMap[key]; exists && idx != -1 && envVar.Value == val && secretsFile.Secrets[idx].Group == group {
+		// Encrypting it again would change the encrypted value, and the file in git, for nothing
+		if envVar.NeedsRotation {
+			logger.Warn().Msgf("%s still needs rotating, change the value where it comes from, then set it again", key)
+		}
+		return false
+	}
+
+	valueKey := symKey
+	if group != "" {
+		valueKey, err = groupKeyForEnv(env, group)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error decrypting the key of group %s", group)
+		}
+	}
+
+	encrypted, err := encryptSecret(valueKey, env, key, personal, val)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error encrypting value")
+	}
+	encrypted.Group = group
+
 	if idx != -1 {
 		// Key exists in this env's secrets, update it
 		logger.Debug().Msgf("Var %s exists in %s, updating", key, env)
-		secretsFile.Secrets[idx].Value = encrypted
+		secretsFile.Secrets[idx] = encrypted
 	} else {
 		// Key doesn't exist in this env (may exist in underlay), append it
 		logger.Debug().Msgf("Var %s does not exist in %s, adding", key, env)
-		secretsFile.Secrets = append(secretsFile.Secrets, EncryptedSecret{
-			Name:     key,
-			Personal: personal,
-			Value:    encrypted,
-		})
+		secretsFile.Secrets = append(secretsFile.Secrets, encrypted)
 
-		if personal {
+		if sharedSecrets != nil {
 			// We need to mark it in the shared secrets that it exists now
-			sharedSecrets, err := readSecretsFile(env, false)
-			if errors.Is(err, os.ErrNotExist) {
-				sharedSecrets = &SecretsFile{}
-			} else if err != nil {
-				logger.Fatal().Err(err).Msg("error reading shared secrets file")
-			}
-
 			sharedSecrets.Secrets = append(sharedSecrets.Secrets, EncryptedSecret{
 				Name:     key,
 				Personal: true,
@@ -135,4 +197,6 @@ func setEnvVar(env, key, val string, personal bool) {
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error writing secrets file")
 	}
+
+	return true
 }
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8), each byte of the secret is split with its own random polynomial.
+// A share is the value of every polynomial at x, followed by x.
+
+var (
+	ErrInvalidShares    = errors.New("invalid shares")
+	ErrDuplicateShareID = errors.New("the same share was given more than once")
+)
+
+// shamirSplit splits secret into shares, any threshold of which can reconstruct it
+func shamirSplit(secret []byte, threshold, shares int) ([][]byte, error) {
+	if threshold < 2 || threshold > shares || shares > 255 {
+		return nil, fmt.Errorf("%w: need 2 <= threshold <= shares <= 255, got threshold %d and %d shares", ErrInvalidShares, threshold, shares)
+	}
+
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret)+1)
+		result[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for b, secretByte := range secret {
+		// The constant term is the secret, the rest are random
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error in rand.Read: %w", err)
+		}
+		coefficients[0] = secretByte
+
+		for i := range result {
+			result[i][b] = gfEvaluate(coefficients, byte(i+1))
+		}
+	}
+
+	return result, nil
+}
+
+// shamirCombine reconstructs the secret from shares, which are only correct if there are at least the threshold
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("%w: need at least 2 shares", ErrInvalidShares)
+	}
+
+	length := len(shares[0]) - 1
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != length+1 || length == 0 {
+			return nil, fmt.Errorf("%w: shares have different lengths", ErrInvalidShares)
+		}
+		xs[i] = share[length]
+		if xs[i] == 0 {
+			return nil, fmt.Errorf("%w: share %d has no id", ErrInvalidShares, i+1)
+		}
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, ErrDuplicateShareID
+			}
+		}
+	}
+
+	// Lagrange interpolation at x = 0, where subtraction is also XOR
+	secret := make([]byte, length)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, x := range xs {
+			if j == i {
+				continue
+			}
+			basis = gfMul(basis, gfMul(x, gfInverse(x^xs[i])))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// gfEvaluate evaluates the polynomial with coefficients (lowest degree first) at x
+func gfEvaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching on the values
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		a = (a << 1) ^ (0x1b & -(a >> 7))
+		b >>= 1
+	}
+	return product
+}
+
+// gfInverse returns the multiplicative inverse of a, which is a^254
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
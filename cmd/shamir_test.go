@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInverse(byte(a))) != 1 {
+			t.Fatalf("%d has no inverse", a)
+		}
+	}
+
+	secret := generateAESKey()
+	shares, err := shamirSplit(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any 3 shares, in any order
+	for _, picked := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var subset [][]byte
+		for _, i := range picked {
+			subset = append(subset, shares[i])
+		}
+		combined, err := shamirCombine(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Fatalf("shares %v did not reconstruct the secret", picked)
+		}
+	}
+
+	combined, err := shamirCombine([][]byte{shares[0], shares[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Fatal("2 shares should not reconstruct the secret")
+	}
+
+	if _, err := shamirCombine([][]byte{shares[0], shares[0], shares[1]}); !errors.Is(err, ErrDuplicateShareID) {
+		t.Fatalf("expected ErrDuplicateShareID, got %v", err)
+	}
+	if _, err := shamirSplit(secret, 1, 5); !errors.Is(err, ErrInvalidShares) {
+		t.Fatalf("expected ErrInvalidShares, got %v", err)
+	}
+	if _, err := shamirSplit(secret, 6, 5); !errors.Is(err, ErrInvalidShares) {
+		t.Fatalf("expected ErrInvalidShares, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// showCmd represents the show command
+var showCmd = &cobra.Command{
+	Use:   "show REV",
+	Short: "Print an environment as it was at a commit",
+	Long: `Print the values of an environment as they were at a commit, as NAME=value lines sorted by name, including
+the values of the environments it overlays.
+
+Values are decrypted with the current key, or the previous keys if the key was rotated since. --mode is how
+values are shown: full, masked or hash, see 'epicenv git-textconv --help'.
+
+Examples:
+  epicenv show HEAD~3 -e prod
+  epicenv show 1a2b3c4d --mode full`,
+	Run:  runShow,
+	Args: cobra.ExactArgs(1),
+}
+
+var showModeFlag string
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+	showCmd.Flags().StringVar(&showModeFlag, "mode", diffModeMasked, "How to show values: full, masked or hash")
+}
+
+func runShow(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+	requireDiffMode(showModeFlag)
+
+	commit, err := gitResolveCommit(getEpicEnvPath(), args[0])
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("error finding commit %s, is the .epicenv directory in a git repository?", args[0])
+	}
+
+	chain, err := getOverlayChain(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error getting overlay chain")
+	}
+
+	// Later layers override earlier ones, values are bound to the environment they are in
+	values := make(map[string]EncryptedSecret)
+	envOf := make(map[string]string)
+	found := false
+	for _, chainEnv := range chain {
+		secretsFile, err := readSecretsAt(commit.Hash, chainEnv)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("error reading secrets file of %s", chainEnv)
+		}
+
+		found = true
+		for _, item := range secretsFile.Secrets {
+			values[item.Name] = item
+			envOf[item.Name] = chainEnv
+		}
+	}
+	if !found {
+		logger.Fatal().Msgf("%s has no values at %.8s", env, commit.Hash)
+	}
+
+	keyrings := make(map[string]*envKeyring)
+	for _, chainEnv := range lo.Uniq(lo.Values(envOf)) {
+		keyrings[chainEnv], err = loadEnvKeyring(chainEnv)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error loading symmetric key")
+		}
+	}
+
+	logger.Info().Msgf("%s at %.8s  %s  %s", env, commit.Hash, commit.Time.Format(time.DateTime), commit.Author)
+	fmt.Print(textconvSecretsFile(&SecretsFile{Secrets: lo.Values(values)}, func(item EncryptedSecret) (string, bool) {
+		keys := keyrings[envOf[item.Name]]
+		value, _, ok := keys.decrypt(item)
+		if !ok {
+			return "", false
+		}
+		return keys.display(showModeFlag, value), true
+	}))
+}
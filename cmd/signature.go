@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// Signatures use the same format as `ssh-keygen -Y sign -n epicenv`, so they can also be checked with
+// `ssh-keygen -Y verify`. See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigVersion   = 1
+	sshSigNamespace = "epicenv"
+	sshSigHash      = "sha512"
+	sshSigPEMType   = "SSH SIGNATURE"
+)
+
+var (
+	ErrUnsigned        = errors.New("file is not signed")
+	ErrUntrustedSigner = errors.New("file was signed by a key that is not invited")
+)
+
+type (
+	// sshSigBlob is the wire format of a signature
+	sshSigBlob struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+
+	// sshSigSignedData is what actually gets signed
+	sshSigSignedData struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}
+)
+
+// signSSHSig signs message and returns the PEM armored signature
+func signSSHSig(signer ssh.Signer, message []byte) ([]byte, error) {
+	hash := sha512.Sum512(message)
+	signedData := append([]byte(sshSigMagic), ssh.Marshal(sshSigSignedData{
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: sshSigHash,
+		Hash:          hash[:],
+	})...)
+
+	var sig *ssh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures are not accepted by ssh-keygen
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, signedData, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, signedData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %w", err)
+	}
+
+	blob := append([]byte(sshSigMagic), ssh.Marshal(sshSigBlob{
+		Version:       sshSigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshSigNamespace,
+		HashAlgorithm: sshSigHash,
+		Signature:     ssh.Marshal(sig),
+	})...)
+
+	// ssh-keygen wraps at 70 columns
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN " + sshSigPEMType + "-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n")
+	armored.WriteString("-----END " + sshSigPEMType + "-----\n")
+
+	return []byte(armored.String()), nil
+}
+
+// verifySSHSig checks the PEM armored signature of message, and returns the public key that signed it
+func verifySSHSig(armored, message []byte) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != sshSigPEMType {
+		return nil, fmt.Errorf("invalid signature armor")
+	}
+
+	if !bytes.HasPrefix(block.Bytes, []byte(sshSigMagic)) {
+		return nil, fmt.Errorf("invalid signature magic")
+	}
+
+	var blob sshSigBlob
+	err := ssh.Unmarshal(block.Bytes[len(sshSigMagic):], &blob)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signature: %w", err)
+	}
+	if blob.Version != sshSigVersion {
+		return nil, fmt.Errorf("unsupported signature version %d", blob.Version)
+	}
+	if blob.Namespace != sshSigNamespace {
+		return nil, fmt.Errorf("unexpected signature namespace %q", blob.Namespace)
+	}
+	if blob.HashAlgorithm != sshSigHash {
+		return nil, fmt.Errorf("unsupported signature hash %q", blob.HashAlgorithm)
+	}
+
+	publicKey, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signature public key: %w", err)
+	}
+
+	var sig ssh.Signature
+	err = ssh.Unmarshal(blob.Signature, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signature: %w", err)
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, fmt.Errorf("SHA-1 RSA signatures are not supported")
+	}
+
+	hash := sha512.Sum512(message)
+	signedData := append([]byte(sshSigMagic), ssh.Marshal(sshSigSignedData{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          hash[:],
+	})...)
+
+	err = publicKey.Verify(signedData, &sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return publicKey, nil
+}
+
+// authorizedKeyString formats a public key like the PublicKey of an EncryptedKey
+func authorizedKeyString(publicKey ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+}
+
+// loadSigner finds a local private key for one of the invited keys to sign with
+func loadSigner(encryptedKeys []EncryptedKey) (ssh.Signer, error) {
+	keyPairs := findPrivateKeysForPublicKeys(lo.Map(encryptedKeys, func(item EncryptedKey, index int) string {
+		return item.PublicKey
+	}))
+	if len(keyPairs) == 0 {
+		return nil, fmt.Errorf("did not find any local private keys matching a known public key")
+	}
+
+	// Use the first key we can parse, e.g. if the passphrase for one is unknown
+	var err error
+	for _, kp := range keyPairs {
+		var privateKey interface{}
+		privateKey, err = parsePrivateKey(kp)
+		if err != nil {
+			logger.Debug().Err(err).Msgf("Could not sign with %s", kp.privateKeyPath)
+			continue
+		}
+
+		if edKey, ok := privateKey.(*ed25519.PrivateKey); ok {
+			privateKey = *edKey
+		}
+
+		return ssh.NewSignerFromKey(privateKey)
+	}
+
+	return nil, err
+}
+
+// signFile writes filePath.sig signed by one of our local keys that is in encryptedKeys.
+// If we can't sign, any stale signature is removed so the file shows up as unsigned instead of tampered.
+func signFile(filePath string, encryptedKeys []EncryptedKey) error {
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	signer, err := loadSigner(encryptedKeys)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("Unable to sign %s, it will be unsigned", filePath)
+		err = os.Remove(filePath + ".sig")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing stale signature: %w", err)
+		}
+		return nil
+	}
+
+	sig, err := signSSHSig(signer, fileBytes)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filePath+".sig", sig, 0777)
+	if err != nil {
+		return fmt.Errorf("error in os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// verifyFileSignature checks filePath.sig, and returns the invited key that signed it
+func verifyFileSignature(filePath string, encryptedKeys []EncryptedKey) (*EncryptedKey, error) {
+	sig, err := os.ReadFile(filePath + ".sig")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnsigned
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+	if len(bytes.TrimSpace(sig)) == 0 {
+		// An empty signature is no signature
+		return nil, ErrUnsigned
+	}
+
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	publicKey, err := verifySSHSig(sig, fileBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signerKey := authorizedKeyString(publicKey)
+	signer, found := lo.Find(encryptedKeys, func(item EncryptedKey) bool {
+		return samePublicKey(item.PublicKey, signerKey)
+	})
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedSigner, ssh.FingerprintSHA256(publicKey))
+	}
+
+	return &signer, nil
+}
+
+// verifyEnvSignatures checks that the keys and shared secrets for env were written by someone who is invited,
+// and that keys.json was changed by an admin we trust, see verifyKeysFile. Returns the keys to trust.
+// A file that is not signed yet is warned about, or is fatal if EPICENV_REQUIRE_SIGNATURES is set. Any other
+// problem is fatal, like a signature by a key that is not invited, a removed signature, or a change signed by
+// someone without the role to make it.
+func verifyEnvSignatures(env string) *KeysFile {
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	chain, err := getOverlayChain(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error getting overlay chain")
+	}
+
+	strict := os.Getenv("EPICENV_REQUIRE_SIGNATURES") != ""
+	report := func(filePath string, err error) {
+		switch {
+		case errors.Is(err, ErrUnsigned) && strict:
+			logger.Fatal().Msgf("%s is not signed, run 'epicenv migrate' to sign it", filePath)
+		case errors.Is(err, ErrUnsigned):
+			logger.Warn().Msgf("%s is not signed, run 'epicenv migrate' to sign it", filePath)
+		case errors.Is(err, ErrInsufficientRole):
+			logger.Fatal().Err(err).Msgf("%s was changed by someone without the role to change it", filePath)
+		default:
+			logger.Fatal().Err(err).Msgf("!!! SIGNATURE CHECK FAILED FOR %s, IT MAY HAVE BEEN TAMPERED WITH !!!", filePath)
+		}
+	}
+
+	keysFile, err := verifyKeysFile(rootEnv)
+	if keysFile == nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+	if err != nil {
+		report(keysFilePath(rootEnv), err)
+	}
+
+	trusted, err := readTrustedKeys(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading the trusted keys")
+	}
+
+	signedFiles := 0
+	for _, chainEnv := range chain {
+		filePath := secretsFilePath(chainEnv, false)
+		if _, err := os.Stat(filePath); err != nil {
+			continue
+		}
+
+		signer, err := verifySecretsSignature(chainEnv, keysFile.EncryptedKeys, trusted)
+		if err != nil {
+			report(filePath, err)
+			continue
+		}
+		logger.Debug().Msgf("%s signed by %s", filePath, signer.Username)
+
+		if trusted != nil && !lo.Contains(trusted.SignedFiles, path.Join(chainEnv, "secrets.json")) {
+			trusted.SignedFiles = append(trusted.SignedFiles, path.Join(chainEnv, "secrets.json"))
+			signedFiles++
+		}
+	}
+
+	if signedFiles > 0 {
+		err = writeTrustedKeys(rootEnv, *trusted)
+		if err != nil {
+			logger.Warn().Err(err).Msg("error saving the trusted keys")
+		}
+	}
+
+	return keysFile
+}
+
+// resignOrphanedSecrets signs the secrets files of rootEnv and its overlays again with our key, if they were
+// validly signed by a writer in before who is not in after, e.g. because they were uninvited or their key was
+// replaced. Otherwise their signature would no longer be trusted.
+func resignOrphanedSecrets(rootEnv string, before, after *KeysFile) error {
+	environments, err := getEnvironmentsForRoot(rootEnv)
+	if err != nil {
+		return fmt.Errorf("error finding overlays of %s: %w", rootEnv, err)
+	}
+
+	for _, env := range environments {
+		filePath := secretsFilePath(env, false)
+		if _, err := os.Stat(filePath); err != nil {
+			continue
+		}
+
+		signer, err := verifySecretsSignature(env, before.EncryptedKeys, nil)
+		if err != nil || lo.ContainsBy(after.EncryptedKeys, func(item EncryptedKey) bool {
+			return samePublicKey(item.PublicKey, signer.PublicKey)
+		}) {
+			continue
+		}
+
+		writers := lo.Filter(after.EncryptedKeys, func(item EncryptedKey, index int) bool {
+			return hasRole(keyRole(item), roleWriter)
+		})
+		if _, err := loadSigner(writers); err != nil {
+			logger.Warn().Err(err).Msgf("%s was signed by %s, who is no longer invited, a writer must set a value or run 'epicenv migrate' to sign it again", filePath, signer.Username)
+			continue
+		}
+		err = signFile(filePath, writers)
+		if err != nil {
+			return fmt.Errorf("error signing %s: %w", filePath, err)
+		}
+		logger.Debug().Msgf("Signed %s again, it was signed by %s who is no longer invited", filePath, signer.Username)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignVerifySSHSig(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, privateKey := range []interface{}{edKey, rsaKey} {
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message := []byte(`{"Secrets":[]}`)
+		sig, err := signSSHSig(signer, message)
+		if err != nil {
+			t.Fatalf("signing with %s failed: %v", signer.PublicKey().Type(), err)
+		}
+
+		publicKey, err := verifySSHSig(sig, message)
+		if err != nil {
+			t.Fatalf("verifying %s failed: %v", signer.PublicKey().Type(), err)
+		}
+		if authorizedKeyString(publicKey) != authorizedKeyString(signer.PublicKey()) {
+			t.Errorf("verified signer does not match for %s", signer.PublicKey().Type())
+		}
+
+		if _, err := verifySSHSig(sig, []byte(`{"Secrets":[{}]}`)); err == nil {
+			t.Errorf("verified a tampered message with %s", signer.PublicKey().Type())
+		}
+	}
+}
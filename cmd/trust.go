@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// keys.json lists the keys that may sign, so it can't vouch for itself. A change to it is only trusted if it
+// was signed by an admin of the keys.json we trusted before: the last one this machine accepted, which is kept
+// outside the repository, or on first use the newest committed version that is signed by an admin of the
+// version before it, starting from the first signed one.
+
+var ErrSignatureRemoved = errors.New("file was signed before, but its signature was removed")
+
+// trustedKeys is what we trusted the last time we checked an environment
+type trustedKeys struct {
+	// Keys is the last keys.json we trusted
+	Keys KeysFile
+	// SignedFiles are the secrets files of the environment, relative to the .epicenv directory, that were
+	// signed when we last checked them
+	SignedFiles []string `json:",omitempty"`
+}
+
+// trustedKeysPath is where we keep what we trusted of rootEnv, by the path of the .epicenv directory
+func trustedKeysPath(rootEnv string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding the config directory: %w", err)
+	}
+
+	epicEnvPath, err := filepath.Abs(getEpicEnvPath())
+	if err != nil {
+		return "", fmt.Errorf("error getting absolute path of .epicenv directory: %w", err)
+	}
+	hash := sha256.Sum256([]byte(epicEnvPath))
+
+	return filepath.Join(configDir, "epicenv", "trust", hex.EncodeToString(hash[:8]), rootEnv+".json"), nil
+}
+
+// readTrustedKeys returns what we trusted of rootEnv, nil if we never checked it
+func readTrustedKeys(rootEnv string) (*trustedKeys, error) {
+	filePath, err := trustedKeysPath(rootEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	fileBytes, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	var trusted trustedKeys
+	err = json.Unmarshal(fileBytes, &trusted)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s, is it corrupted?: %w", filePath, err)
+	}
+
+	return &trusted, nil
+}
+
+func writeTrustedKeys(rootEnv string, trusted trustedKeys) error {
+	filePath, err := trustedKeysPath(rootEnv)
+	if err != nil {
+		return err
+	}
+
+	fileBytes, err := json.MarshalIndent(trusted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error in json.MarshalIndent: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return fmt.Errorf("error in os.MkdirAll: %w", err)
+	}
+
+	err = os.WriteFile(filePath, fileBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("error in os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// checkKeysChange checks that keysFile, read from fileBytes, was signed with sig by an admin of anchor, or of
+// keysFile itself if we don't trust any version yet. Returns the signer.
+func checkKeysChange(anchor, keysFile *KeysFile, fileBytes, sig []byte) (*EncryptedKey, error) {
+	if len(bytes.TrimSpace(sig)) == 0 {
+		if anchor != nil {
+			return nil, ErrSignatureRemoved
+		}
+		return nil, ErrUnsigned
+	}
+
+	publicKey, err := verifySSHSig(sig, fileBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if anchor == nil {
+		anchor = keysFile
+	}
+	signerKey := authorizedKeyString(publicKey)
+	signer, found := lo.Find(anchor.EncryptedKeys, func(item EncryptedKey) bool {
+		return samePublicKey(item.PublicKey, signerKey)
+	})
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedSigner, ssh.FingerprintSHA256(publicKey))
+	}
+	if !hasRole(keyRole(signer), roleAdmin) {
+		return nil, fmt.Errorf("%w: it was signed by %s who was a %s, only admins can change it", ErrInsufficientRole, signer.Username, keyRole(signer))
+	}
+
+	return &signer, nil
+}
+
+// keysVersion is keys.json at one commit
+type keysVersion struct {
+	Hash      string
+	FileBytes []byte
+	Sig       []byte
+	KeysFile  KeysFile
+}
+
+// committedKeysVersions returns the committed versions of keys.json of rootEnv, oldest first
+func committedKeysVersions(rootEnv string) ([]keysVersion, error) {
+	epicEnvPath := getEpicEnvPath()
+	filePath := path.Join(rootEnv, "keys.json")
+
+	commits, err := gitLog(epicEnvPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []keysVersion
+	for _, commit := range commits {
+		fileBytes, err := gitShow(epicEnvPath, commit.Hash, filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var keysFile KeysFile
+		if err := json.Unmarshal(fileBytes, &keysFile); err != nil {
+			logger.Debug().Err(err).Msgf("Skipping keys.json at %.8s", commit.Hash)
+			continue
+		}
+
+		sig, err := gitShow(epicEnvPath, commit.Hash, filePath+".sig")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		versions = append(versions, keysVersion{Hash: commit.Hash, FileBytes: fileBytes, Sig: sig, KeysFile: keysFile})
+	}
+
+	return versions, nil
+}
+
+// advanceTrust returns the newest of versions that was signed by an admin of the version trusted before it,
+// starting from anchor. Versions up to the last one equal to anchor are skipped, they were trusted already.
+func advanceTrust(anchor *KeysFile, versions []keysVersion) *KeysFile {
+	start := 0
+	if anchor != nil {
+		for i, version := range versions {
+			if reflect.DeepEqual(version.KeysFile, *anchor) {
+				start = i + 1
+			}
+		}
+	}
+
+	for _, version := range versions[start:] {
+		if _, err := checkKeysChange(anchor, &version.KeysFile, version.FileBytes, version.Sig); err != nil {
+			logger.Debug().Err(err).Msgf("Not trusting keys.json at %.8s", version.Hash)
+			continue
+		}
+		anchor = &version.KeysFile
+	}
+
+	return anchor
+}
+
+// verifyKeysFile checks that keys.json of rootEnv was changed by an admin we trust, and returns the keys to
+// trust: keys.json if it was, otherwise the last version we trusted, or keys.json if we never trusted one.
+func verifyKeysFile(rootEnv string) (*KeysFile, error) {
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		return nil, err
+	}
+	fileBytes, err := os.ReadFile(keysFilePath(rootEnv))
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+	sig, err := os.ReadFile(keysFilePath(rootEnv) + ".sig")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error in os.ReadFile: %w", err)
+	}
+
+	trusted, err := readTrustedKeys(rootEnv)
+	if err != nil {
+		return nil, err
+	}
+	var anchor *KeysFile
+	if trusted != nil {
+		anchor = &trusted.Keys
+	}
+
+	check := func(anchor *KeysFile) error {
+		if anchor != nil && reflect.DeepEqual(*anchor, *keysFile) {
+			// Nothing changed since we trusted it, but the signature must still be there
+			if len(bytes.TrimSpace(sig)) == 0 {
+				return ErrSignatureRemoved
+			}
+			_, err := verifySSHSig(sig, fileBytes)
+			return err
+		}
+		_, err := checkKeysChange(anchor, keysFile, fileBytes, sig)
+		return err
+	}
+
+	committedVersions := func() []keysVersion {
+		versions, err := committedKeysVersions(rootEnv)
+		if err != nil {
+			logger.Debug().Err(err).Msg("Not checking the committed versions of keys.json")
+		}
+		return versions
+	}
+
+	if anchor == nil {
+		// On first use, the committed versions are trusted before keys.json can vouch for itself
+		anchor = advanceTrust(nil, committedVersions())
+		err = check(anchor)
+	} else if err = check(anchor); err != nil {
+		// Admins may have changed since we last checked, the committed versions can tell
+		if newer := advanceTrust(anchor, committedVersions()); newer != anchor {
+			anchor = newer
+			err = check(anchor)
+		}
+	}
+	if err != nil {
+		return lo.Ternary(anchor != nil, anchor, keysFile), err
+	}
+
+	if trusted == nil {
+		trusted = &trustedKeys{}
+	}
+	if !reflect.DeepEqual(trusted.Keys, *keysFile) {
+		trusted.Keys = *keysFile
+		err = writeTrustedKeys(rootEnv, *trusted)
+		if err != nil {
+			return nil, fmt.Errorf("error saving the trusted keys: %w", err)
+		}
+	}
+
+	return keysFile, nil
+}
+
+// verifySecretsSignature checks that the shared secrets of env were signed by a writer in keys. A missing
+// signature is ErrSignatureRemoved if it was signed when we last checked.
+func verifySecretsSignature(env string, keys []EncryptedKey, trusted *trustedKeys) (*EncryptedKey, error) {
+	signer, err := verifyFileSignature(secretsFilePath(env, false), keys)
+	if errors.Is(err, ErrUnsigned) && trusted != nil && lo.Contains(trusted.SignedFiles, path.Join(env, "secrets.json")) {
+		return nil, ErrSignatureRemoved
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasRole(keyRole(*signer), roleWriter) {
+		return nil, fmt.Errorf("%w: it was signed by %s who is a %s, only writers can change it", ErrInsufficientRole, signer.Username, keyRole(*signer))
+	}
+
+	return signer, nil
+}
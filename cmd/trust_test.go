@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckKeysChange(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	admin, reader := newSigner(), newSigner()
+
+	anchor := &KeysFile{EncryptedKeys: []EncryptedKey{
+		{Username: "alice", PublicKey: authorizedKeyString(admin.PublicKey()), Role: roleAdmin},
+		{Username: "bob", PublicKey: authorizedKeyString(reader.PublicKey()), Role: roleReader},
+	}}
+	// Bob made himself an admin
+	changed := &KeysFile{EncryptedKeys: []EncryptedKey{anchor.EncryptedKeys[0], anchor.EncryptedKeys[1]}}
+	changed.EncryptedKeys[1].Role = roleAdmin
+	fileBytes, err := json.MarshalIndent(changed, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(signer ssh.Signer) []byte {
+		sig, err := signSSHSig(signer, fileBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	if _, err := checkKeysChange(anchor, changed, fileBytes, sign(reader)); !errors.Is(err, ErrInsufficientRole) {
+		t.Errorf("signed by a reader of the anchor: err = %v, want ErrInsufficientRole", err)
+	}
+	if signer, err := checkKeysChange(anchor, changed, fileBytes, sign(admin)); err != nil || signer.Username != "alice" {
+		t.Errorf("signed by an admin of the anchor: signer = %v, err = %v", signer, err)
+	}
+	if _, err := checkKeysChange(anchor, changed, fileBytes, nil); !errors.Is(err, ErrSignatureRemoved) {
+		t.Errorf("unsigned with an anchor: err = %v, want ErrSignatureRemoved", err)
+	}
+	if _, err := checkKeysChange(nil, changed, fileBytes, []byte("\n")); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned without an anchor: err = %v, want ErrUnsigned", err)
+	}
+	// Without an anchor the file is trusted on first use
+	if _, err := checkKeysChange(nil, changed, fileBytes, sign(reader)); err != nil {
+		t.Errorf("signed by an admin of itself without an anchor: err = %v", err)
+	}
+	if _, err := checkKeysChange(anchor, changed, fileBytes, sign(newSigner())); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("signed by a key that is not invited: err = %v, want ErrUntrustedSigner", err)
+	}
+
+	// The chain of versions only advances through versions signed by an admin of the one before
+	versions := []keysVersion{
+		{Hash: "first", KeysFile: *anchor},
+		{Hash: "forged", KeysFile: *changed, FileBytes: fileBytes, Sig: sign(reader)},
+		{Hash: "stripped", KeysFile: *changed, FileBytes: fileBytes},
+	}
+	versions[0].FileBytes, _ = json.MarshalIndent(anchor, "", "  ")
+	versions[0].Sig, _ = signSSHSig(admin, versions[0].FileBytes)
+
+	if got := advanceTrust(nil, versions); got == nil || !reflect.DeepEqual(*got, *anchor) {
+		t.Errorf("advanceTrust() = %+v, want the first version", got)
+	}
+	versions = append(versions, keysVersion{Hash: "approved", KeysFile: *changed, FileBytes: fileBytes, Sig: sign(admin)})
+	if got := advanceTrust(anchor, versions); got == nil || !reflect.DeepEqual(*got, *changed) {
+		t.Errorf("advanceTrust() = %+v, want the approved version", got)
+	}
+}
@@ -4,6 +4,11 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 )
@@ -11,27 +16,56 @@ import (
 // uninviteCmd represents the uninvite command
 var uninviteCmd = &cobra.Command{
 	Use:   "uninvite [name]",
-	Short: "Uninvite a GitHub user or remove a headless key from the environment",
-	Long: `Uninvite a GitHub user or remove a headless key from the environment, removing their access by re-encrypting.
-This is not a replacement for rotating secrets!
+	Short: "Uninvite a user or remove a headless key from the environment",
+	Long: `Uninvite a user or remove a headless key from the environment.
+
+Invites belong to the root environment, so uninviting from an overlay uninvites from the root and every
+overlay on top of it.
+
+They could have kept the symmetric key, use --rotate to also rotate it like 'epicenv rotate-key'. That marks
+the shared values they could read as needing rotation, which loading the environment warns about until they
+are set again. This is not a replacement for rotating secrets!
+
+If they held a share of the split key, the split is removed, as their share would still count towards
+recovering the key. Split it again with 'epicenv recovery split'.
 
 Examples:
-  epicenv uninvite username    # Uninvite a GitHub user
-  epicenv uninvite keyname     # Remove a headless key`,
+  epicenv uninvite username          # Uninvite a GitHub user
+  epicenv uninvite gitlab:user       # Uninvite a GitLab user
+  epicenv uninvite keyname           # Remove a headless key
+  epicenv uninvite username --rotate # Uninvite a user and rotate the key`,
 	Run:  runUninvite,
 	Args: cobra.ExactArgs(1),
 }
 
+var uninviteRotateFlag bool
+
 func init() {
 	rootCmd.AddCommand(uninviteCmd)
+	uninviteCmd.Flags().BoolVar(&uninviteRotateFlag, "rotate", false, "Also rotate the symmetric key, and mark the values they could read as needing rotation")
 }
 
 func runUninvite(cmd *cobra.Command, args []string) {
 	name := args[0]
 	env := getEnvOrFlag(cmd)
 
+	// github:alice is stored as alice
+	if normalized, err := normalizeUserSpec(name); err == nil {
+		name = normalized
+	}
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	if rootEnv != env {
+		logger.Warn().Msgf("Note: Uninviting from root environment '%s' (overlays inherit access)", rootEnv)
+	}
+
 	// Load in the keys
-	keysFile, err := readKeysFile(env)
+	keysFile, err := readKeysFile(rootEnv)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error reading keys file")
 	}
@@ -44,12 +78,19 @@ func runUninvite(cmd *cobra.Command, args []string) {
 	}
 
 	// Load the symmetric key (so we know that we are invited to the env)
-	_, err = loadSymmetricKey(env)
+	symKey, err := loadSymmetricKey(env)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error loading symmetric key")
 	}
 
-	// Check if it's a headless key or GitHub user
+	requireRole(rootEnv, roleAdmin)
+
+	// Make sure someone can still manage the environment
+	if !hasAdminWithout(keysFile, []string{name}) {
+		logger.Fatal().Msgf("Refusing to uninvite '%s', they are the last admin", name)
+	}
+
+	// Check if it's a headless key or user
 	isHeadless := false
 	for _, key := range keysFile.EncryptedKeys {
 		if key.Username == name && key.IsHeadless {
@@ -58,13 +99,16 @@ func runUninvite(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Remove the key
-	keysFile.EncryptedKeys = lo.Filter(keysFile.EncryptedKeys, func(item EncryptedKey, index int) bool {
-		return item.Username != name
+	// They could also read the values in their groups
+	groups := lo.FilterMap(keysFile.Groups, func(group Group, index int) (string, bool) {
+		return group.Name, lo.Contains(groupMembers(&group), name)
 	})
 
+	// Remove the key
+	removeUsers(keysFile, []string{name})
+
 	// Write the updated keys file
-	err = writeKeysFile(env, *keysFile)
+	err = writeKeysFile(rootEnv, *keysFile)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("error writing keys file")
 	}
@@ -72,6 +116,114 @@ func runUninvite(cmd *cobra.Command, args []string) {
 	if isHeadless {
 		logger.Info().Msgf("Removed headless key '%s' **THIS IS NOT A REPLACEMENT FOR ROTATING SECRETS!**", name)
 	} else {
-		logger.Info().Msgf("Removed GitHub user '%s' **THIS IS NOT A REPLACEMENT FOR ROTATING SECRETS!**", name)
+		logger.Info().Msgf("Removed user '%s' **THIS IS NOT A REPLACEMENT FOR ROTATING SECRETS!**", name)
+	}
+
+	if !uninviteRotateFlag {
+		return
+	}
+
+	markUninvitedValues(rootEnv, []string{name}, groups, symKey, true)
+}
+
+// markUninvitedValues marks the values that names could read after they were uninvited, the shared ones and those in
+// groups, as needing rotation, after rotating the key of rootEnv if rotate is set
+func markUninvitedValues(rootEnv string, names, groups []string, symKey []byte, rotate bool) {
+	who := strings.Join(lo.Map(names, func(name string, index int) string {
+		return "'" + name + "'"
+	}), ", ")
+
+	if rotate {
+		generation, rotated, err := rotateSymmetricKey(rootEnv, symKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error rotating symmetric key, they are uninvited, run 'epicenv rotate-key' to try again")
+		}
+		logger.Info().Msgf("Rotated the key for %s to generation %d, re-encrypted %d shared values", rootEnv, generation, rotated)
 	}
+
+	marked, err := markNeedsRotation(rootEnv, groups)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error marking values as needing rotation")
+	}
+	if len(marked) > 0 {
+		logger.Warn().Msgf("%s could read these values, change them where they come from and set them again: %s", who, strings.Join(marked, ", "))
+	}
+	if rotate && len(groups) > 0 {
+		logger.Warn().Msgf("The keys of groups %s were not rotated, so %s could still decrypt values set in them later", strings.Join(groups, ", "), who)
+	}
+}
+
+// markNeedsRotation marks the shared values of rootEnv and its overlays that are not in a group, or in one of groups,
+// as needing rotation. Returns the names of the values that were marked.
+func markNeedsRotation(rootEnv string, groups []string) ([]string, error) {
+	environments, err := getEnvironmentsForRoot(rootEnv)
+	if err != nil {
+		return nil, fmt.Errorf("error finding overlays of %s: %w", rootEnv, err)
+	}
+
+	var marked []string
+	for _, env := range environments {
+		secretsFile, err := readSecretsFile(env, false)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading secrets file for %s: %w", env, err)
+		}
+
+		changed := false
+		for i, item := range secretsFile.Secrets {
+			if item.Personal || (item.Group != "" && !lo.Contains(groups, item.Group)) {
+				continue
+			}
+			marked = append(marked, item.Name)
+			if !item.NeedsRotation {
+				secretsFile.Secrets[i].NeedsRotation = true
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+		err = writeSecretsFile(env, *secretsFile, false)
+		if err != nil {
+			return nil, fmt.Errorf("error writing secrets file for %s: %w", env, err)
+		}
+	}
+
+	return lo.Uniq(marked), nil
+}
+
+// removeUsers removes every key of usernames from keysFile, including from groups. If any of them held a share
+// of the split key, the split is removed.
+func removeUsers(keysFile *KeysFile, usernames []string) {
+	keysFile.EncryptedKeys = lo.Filter(keysFile.EncryptedKeys, func(item EncryptedKey, index int) bool {
+		return !lo.Contains(usernames, item.Username)
+	})
+	for i := range keysFile.Groups {
+		keysFile.Groups[i].EncryptedKeys = lo.Filter(keysFile.Groups[i].EncryptedKeys, func(item EncryptedKey, index int) bool {
+			return !lo.Contains(usernames, item.Username)
+		})
+	}
+
+	// Removing their shares wouldn't take away the ones they already decrypted, which still count towards the
+	// threshold. Splitting again makes new shares that don't combine with the old ones.
+	if keysFile.Split == nil {
+		return
+	}
+	holders := lo.Uniq(lo.FilterMap(keysFile.Split.Shares, func(item EncryptedKey, index int) (string, bool) {
+		return item.Username, lo.Contains(usernames, item.Username)
+	}))
+	if len(holders) > 0 {
+		keysFile.Split = nil
+		logger.Warn().Msgf("The split key was removed, as %s held a share, run 'epicenv recovery split' to split it again", strings.Join(holders, ", "))
+	}
+}
+
+// hasAdminWithout checks whether anyone but usernames can still manage the environment
+func hasAdminWithout(keysFile *KeysFile, usernames []string) bool {
+	return lo.ContainsBy(keysFile.EncryptedKeys, func(item EncryptedKey) bool {
+		return !lo.Contains(usernames, item.Username) && keyRole(item) == roleAdmin
+	})
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"github.com/samber/lo"
+	"github.com/spf13/cobra"
+)
+
+// verifyInvitesCmd represents the verify-invites command
+var verifyInvitesCmd = &cobra.Command{
+	Use:   "verify-invites",
+	Short: "Compare the invited keys with the users' current keys",
+	Long: `Compare the keys invited to the EpicEnv with the keys their key source has for them right now.
+
+Reports users who have new keys that are not invited, invited keys the user no longer has, and keys that no
+longer match the fingerprint they were invited with. Exits with an error if anything doesn't match, so it
+can be used in CI. Nothing is changed, use 'epicenv refresh-keys' to sync.
+
+Example:
+  epicenv verify-invites -e prod`,
+	Run:  runVerifyInvites,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(verifyInvitesCmd)
+}
+
+func runVerifyInvites(cmd *cobra.Command, args []string) {
+	env := getEnvOrFlag(cmd)
+
+	// Resolve to root environment for overlays
+	rootEnv, err := resolveRootEnv(env)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error resolving root environment")
+	}
+
+	keysFile, err := readKeysFile(rootEnv)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("error reading keys file")
+	}
+
+	problems := 0
+	for _, key := range keysFile.EncryptedKeys {
+		if key.IsRecovery {
+			continue
+		}
+		if _, err := checkKeyFingerprint(key); err != nil {
+			logger.Error().Err(err).Msgf("%s: invited key is not the one that was invited", key.Username)
+			problems++
+		}
+	}
+
+	usernames := lo.Uniq(lo.FilterMap(keysFile.EncryptedKeys, func(item EncryptedKey, index int) (string, bool) {
+		return item.Username, !item.IsHeadless
+	}))
+	for _, username := range usernames {
+		foundKeys, err := getKeysForUser(username)
+		if err != nil {
+			logger.Error().Err(err).Msgf("%s: could not fetch keys", username)
+			problems++
+			continue
+		}
+
+		newKeys, removedKeys := diffUserKeys(keysFile, username, foundKeys)
+		if len(newKeys) == 0 && len(removedKeys) == 0 {
+			logger.Info().Msgf("%s: OK", username)
+			continue
+		}
+
+		if len(newKeys) > 0 {
+			logNewKeys(username, newKeys)
+		}
+		if len(removedKeys) > 0 {
+			logger.Warn().Msgf("%s no longer has %d invited keys:", username, len(removedKeys))
+			for _, key := range removedKeys {
+				fingerprint, err := keyFingerprint(key)
+				if err != nil {
+					fingerprint = err.Error()
+				}
+				logger.Warn().Msgf("  %s %s", keyType(key), fingerprint)
+			}
+		}
+		problems++
+	}
+
+	if problems > 0 {
+		logger.Fatal().Msgf("Found %d problems with the invites of %s", problems, rootEnv)
+	}
+
+	logger.Info().Msgf("All %d users match their key source", len(usernames))
+}